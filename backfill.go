@@ -0,0 +1,375 @@
+package caribou
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+// A Backfill eagerly migrates every map in a bucket to the latest version, so that old
+// migrations can eventually be retired. Keys are read page by page from the `$bucket` secondary
+// index, which makes the run resumable, or from a key listing on backends without 2i support.
+type Backfill struct {
+	// BucketName is the bucket to backfill. Maps are read from the BucketTypeMaps bucket type.
+	BucketName string
+
+	// Service is used to talk to Riak, usually a *RiakService.
+	Service RiakExecutor
+
+	// NewModel returns an empty model that a single map is loaded into.
+	NewModel func() Model
+
+	// Concurrency is the number of keys processed at the same time. Defaults to 1.
+	Concurrency int
+
+	// Rate limits the number of keys processed per second. Zero means no limit.
+	Rate float64
+
+	// PageSize is the number of keys requested from the index at a time. Defaults to 1000.
+	PageSize uint32
+
+	// Checkpoint resumes a previous run from the checkpoint it reported to OnCheckpoint.
+	Checkpoint string
+
+	// ListKeys reads keys with a full key listing instead of the `$bucket` index. Listings
+	// can't be resumed, so Checkpoint must be empty and OnCheckpoint is only called once at the
+	// end.
+	ListKeys bool
+
+	// DryRun loads and migrates every map without writing anything back.
+	DryRun bool
+
+	// RewriteRegisters also writes back maps that are at the latest version but still have
+	// registers in the legacy encoding, which saving re-encodes.
+	RewriteRegisters bool
+
+	// OnCheckpoint is called after every page of keys has been processed, with a checkpoint to
+	// resume from and the progress so far. The checkpoint is empty once the bucket is done.
+	OnCheckpoint func(checkpoint string, report BackfillReport)
+
+	// OnError is called for every key that can't be loaded or stored. The backfill carries on
+	// with the next key.
+	OnError func(key string, err error)
+
+	// storage overrides where keys and maps are read from and written to. It is only set by
+	// tests; the backfill uses Riak otherwise.
+	storage backfillStorage
+}
+
+// BackfillReport describes the progress of a Backfill.
+type BackfillReport struct {
+	// Keys is the number of keys processed.
+	Keys int
+
+	// Migrated is the number of maps that had to be migrated and were written back, or would
+	// have been in a dry run.
+	Migrated int
+
+	// Rewritten is the number of maps that didn't need migrating but were written back to
+	// re-encode legacy registers, or would have been in a dry run.
+	Rewritten int
+
+	// Failed is the number of keys that couldn't be loaded or stored.
+	Failed int
+
+	// Missing is the number of keys that were deleted after they were listed.
+	Missing int
+
+	// Versions counts the maps by the version they were stored at. Missing keys aren't counted.
+	Versions map[string]int
+}
+
+// Run runs the backfill until every key has been processed or reading keys fails. The returned
+// report is filled in either way.
+func (b *Backfill) Run() (BackfillReport, error) {
+	if b.NewModel == nil {
+		return BackfillReport{}, errors.New("Backfill has no NewModel function")
+	}
+
+	if b.ListKeys && b.Checkpoint != "" {
+		return BackfillReport{}, errors.New("Backfill can't resume from a checkpoint with ListKeys")
+	}
+
+	r := &backfillRun{b: b, storage: b.storage,
+		report: BackfillReport{Versions: make(map[string]int)}}
+	if r.storage == nil {
+		r.storage = riakBackfill{b.BucketName, b.Service}
+	}
+
+	// Rates too high to be expressed as an interval don't limit anything.
+	if interval := time.Duration(float64(time.Second) / b.Rate); b.Rate > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		r.tick = ticker.C
+	}
+
+	var err error
+	if b.ListKeys {
+		err = r.listKeys()
+	} else {
+		err = r.queryIndex()
+	}
+	return r.snapshot(), err
+}
+
+// backfillRun holds the state of a single Backfill.Run.
+type backfillRun struct {
+	b       *Backfill
+	storage backfillStorage
+	tick    <-chan time.Time
+
+	mu     sync.Mutex
+	report BackfillReport
+}
+
+// queryIndex processes the bucket page by page using the `$bucket` index.
+func (r *backfillRun) queryIndex() error {
+	pageSize := r.b.PageSize
+	if pageSize == 0 {
+		pageSize = 1000
+	}
+	continuation := r.b.Checkpoint
+
+	for {
+		keys, next, err := r.storage.queryIndex(continuation, pageSize)
+		if err != nil {
+			return err
+		}
+		r.processPage(keys)
+
+		continuation = next
+		r.checkpoint(continuation)
+		if continuation == "" {
+			return nil
+		}
+	}
+}
+
+// listKeys processes the bucket using a streaming key listing.
+func (r *backfillRun) listKeys() error {
+	if err := r.storage.listKeys(r.processPage); err != nil {
+		return err
+	}
+	r.checkpoint("")
+	return nil
+}
+
+// processPage processes the keys with up to Concurrency workers and waits for all of them.
+func (r *backfillRun) processPage(keys []string) {
+	workers := r.b.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				r.process(key)
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		if r.tick != nil {
+			<-r.tick
+		}
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// process migrates a single key and records the outcome in the report.
+func (r *backfillRun) process(key string) {
+	version, outcome, err := r.migrate(key)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Keys++
+	if err != nil {
+		r.report.Failed++
+		if r.b.OnError != nil {
+			r.b.OnError(key, err)
+		}
+		return
+	}
+	if outcome == backfillMissing {
+		r.report.Missing++
+		return
+	}
+	r.report.Versions[version]++
+	switch outcome {
+	case backfillMigrated:
+		r.report.Migrated++
+	case backfillRewritten:
+		r.report.Rewritten++
+	}
+}
+
+// backfillOutcome is what happened to a single key.
+type backfillOutcome int
+
+const (
+	backfillSkipped backfillOutcome = iota
+	backfillMigrated
+	backfillRewritten
+	backfillMissing
+)
+
+// migrate loads the map with the given key and writes it back if it had to be migrated, or if
+// its registers have to be re-encoded. It returns the version the map was stored at.
+func (r *backfillRun) migrate(key string) (string, backfillOutcome, error) {
+	resp, err := r.storage.fetch(key)
+	if err != nil {
+		return "", backfillSkipped, err
+	}
+	if resp == nil {
+		// Keys deleted since they were listed have no version.
+		return "", backfillMissing, nil
+	}
+
+	model := r.b.NewModel()
+	original, err := loadRiakModel(resp, model, keepOriginal)
+	if err != nil {
+		return "", backfillSkipped, err
+	}
+
+	// Maps that are already at the latest version only need writing to re-encode registers.
+	// Every register is set on save, so diffing against the snapshot is enough for that.
+	version, outcome := model.GetVersion(), backfillMigrated
+	if original == nil {
+		if !r.b.RewriteRegisters || !hasLegacyRegisters(resp.Map) {
+			return version, backfillSkipped, nil
+		}
+		original, outcome = model.GetSnapshot(), backfillRewritten
+	} else {
+		// Read the stored version from the original map.
+		stored := r.b.NewModel()
+		err = decodeMap(original, stored, nil)
+		if err != nil {
+			return "", backfillSkipped, err
+		}
+		version = stored.GetVersion()
+	}
+	if r.b.DryRun {
+		return version, outcome, nil
+	}
+
+	// Write the changes made by the migrations, diffed against the map as it was stored.
+	ops, err := buildMapOperations(model, original)
+	if err != nil {
+		return version, backfillSkipped, err
+	}
+	if err := r.storage.update(key, ops, model.GetContext()); err != nil {
+		return version, backfillSkipped, err
+	}
+	return version, outcome, nil
+}
+
+// checkpoint reports the progress to OnCheckpoint.
+func (r *backfillRun) checkpoint(continuation string) {
+	if r.b.OnCheckpoint != nil {
+		r.b.OnCheckpoint(continuation, r.snapshot())
+	}
+}
+
+// snapshot returns a copy of the report that is safe to hand out.
+func (r *backfillRun) snapshot() BackfillReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := r.report
+	report.Versions = make(map[string]int, len(r.report.Versions))
+	for v, n := range r.report.Versions {
+		report.Versions[v] = n
+	}
+	return report
+}
+
+// backfillStorage is where a Backfill reads keys and maps from and writes migrated maps to.
+type backfillStorage interface {
+	// queryIndex returns a page of keys starting at continuation and the continuation of the
+	// next page, which is empty after the last page.
+	queryIndex(continuation string, pageSize uint32) ([]string, string, error)
+
+	// listKeys streams all keys to process.
+	listKeys(process func(keys []string)) error
+
+	// fetch returns the map with the given key, or nil if it doesn't exist.
+	fetch(key string) (*riak.FetchMapResponse, error)
+
+	// update applies the map operations to the map with the given key.
+	update(key string, ops []*riak.MapOperation, ctx string) error
+}
+
+// riakBackfill is the backfillStorage of a bucket in Riak.
+type riakBackfill struct {
+	bucketName string
+	rs         RiakExecutor
+}
+
+func (rb riakBackfill) queryIndex(continuation string,
+pageSize uint32) ([]string, string, error) {
+	builder := riak.NewSecondaryIndexQueryCommandBuilder().
+	WithBucketType(BucketTypeMaps).
+	WithBucket(rb.bucketName).
+	WithIndexName("$bucket").
+	WithIndexKey(rb.bucketName).
+	WithMaxResults(pageSize)
+	if continuation != "" {
+		builder.WithContinuation([]byte(continuation))
+	}
+	cmd, err := builder.Build()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = rb.rs.Exec(func(client *riak.Client) error {
+		return client.Execute(cmd)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp := cmd.(*riak.SecondaryIndexQueryCommand).Response
+	keys := make([]string, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		keys = append(keys, string(result.ObjectKey))
+	}
+	return keys, string(resp.Continuation), nil
+}
+
+func (rb riakBackfill) listKeys(process func(keys []string)) error {
+	cmd, err := riak.NewListKeysCommandBuilder().
+	WithBucketType(BucketTypeMaps).
+	WithBucket(rb.bucketName).
+	WithAllowListing().
+	WithStreaming(true).
+	WithCallback(func(keys []string) error {
+		process(keys)
+		return nil
+	}).
+	Build()
+	if err != nil {
+		return err
+	}
+
+	return rb.rs.Exec(func(client *riak.Client) error {
+		return client.Execute(cmd)
+	})
+}
+
+func (rb riakBackfill) fetch(key string) (*riak.FetchMapResponse, error) {
+	return fetchRiakMap(rb.bucketName, key, rb.rs)
+}
+
+func (rb riakBackfill) update(key string, ops []*riak.MapOperation, ctx string) error {
+	_, err := updateRiakMap(ops, rb.bucketName, key, ctx, false, rb.rs)
+	return err
+}
@@ -0,0 +1,201 @@
+package caribou
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+// memoryBackfill is a backfillStorage that reads and writes a fixed list of keys in a
+// MemoryStore. Its continuations are offsets into the list.
+type memoryBackfill struct {
+	store *MemoryStore
+	keys  []string
+	fail  map[string]error
+}
+
+func (m *memoryBackfill) queryIndex(continuation string,
+pageSize uint32) ([]string, string, error) {
+	start := 0
+	if continuation != "" {
+		var err error
+		if start, err = strconv.Atoi(continuation); err != nil {
+			return nil, "", err
+		}
+	}
+	end := start + int(pageSize)
+	if end >= len(m.keys) {
+		return m.keys[start:], "", nil
+	}
+	return m.keys[start:end], strconv.Itoa(end), nil
+}
+
+func (m *memoryBackfill) listKeys(process func(keys []string)) error {
+	process(m.keys)
+	return nil
+}
+
+func (m *memoryBackfill) fetch(key string) (*riak.FetchMapResponse, error) {
+	if err := m.fail[key]; err != nil {
+		return nil, err
+	}
+	rm, ctx, ok := m.store.Fetch(key)
+	if !ok {
+		return nil, nil
+	}
+	return &riak.FetchMapResponse{Context: ctx, Map: rm}, nil
+}
+
+func (m *memoryBackfill) update(key string, ops []*riak.MapOperation, ctx string) error {
+	return storeUpdate(m.store, key)(ops, ctx)
+}
+
+// newGizmoBackfill stores two old gizmos, "a" and "c", and a current one, "b", and returns a
+// backfill of them.
+func newGizmoBackfill(t *testing.T) (*Backfill, *memoryBackfill) {
+	store := NewMemoryStore()
+	storeOldGizmo(t, store, "a")
+	storeOldGizmo(t, store, "c")
+
+	version, err := encodeRegister("colour_to_color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	color, err := encodeRegister("red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var op riak.MapOperation
+	op.Map("ModelMetadata").SetRegister("Version", []byte(version))
+	op.SetRegister("Color", []byte(color))
+	if _, err := store.Apply("b", &op); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &memoryBackfill{store: store, keys: []string{"a", "b", "c"}}
+	return &Backfill{
+		BucketName: "gizmos",
+		NewModel:   func() Model { return &Gizmo{} },
+		OnError:    func(key string, err error) { t.Errorf("Unexpected error for %s: %v", key, err) },
+		storage:    storage,
+	}, storage
+}
+
+func TestBackfill(t *testing.T) {
+	b, storage := newGizmoBackfill(t)
+	report, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 3 || report.Migrated != 2 || report.Failed != 0 || report.Missing != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if report.Versions[""] != 2 || report.Versions["colour_to_color"] != 1 {
+		t.Errorf("Unexpected versions %v", report.Versions)
+	}
+
+	for _, key := range storage.keys {
+		var g Gizmo
+		if ok, err := storage.store.Find(&g, key); !ok || err != nil {
+			t.Fatalf("Failed to find %s: %v", key, err)
+		}
+		rm, _, _ := storage.store.Fetch(key)
+		if _, ok := rm.Registers["Colour"]; ok || g.Color == "" {
+			t.Errorf("Expected %s to be migrated, got %+v", key, rm)
+		}
+	}
+}
+
+func TestBackfillDryRun(t *testing.T) {
+	b, storage := newGizmoBackfill(t)
+	b.DryRun = true
+	report, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 3 || report.Migrated != 2 || report.Versions[""] != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	rm, _, _ := storage.store.Fetch("a")
+	if string(rm.Registers["Colour"]) != "blue" {
+		t.Errorf("Expected nothing to be written, got %+v", rm)
+	}
+}
+
+func TestBackfillMissingKeys(t *testing.T) {
+	b, storage := newGizmoBackfill(t)
+
+	// c is deleted after the keys were listed.
+	storage.store.Remove("c")
+	report, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 3 || report.Missing != 1 || report.Migrated != 1 || report.Failed != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if len(report.Versions) != 2 || report.Versions[""] != 1 ||
+		report.Versions["colour_to_color"] != 1 {
+		t.Errorf("Expected the missing key not to be counted, got %v", report.Versions)
+	}
+}
+
+func TestBackfillCheckpoints(t *testing.T) {
+	b, _ := newGizmoBackfill(t)
+	b.PageSize = 1
+	b.DryRun = true
+	var checkpoints []string
+	b.OnCheckpoint = func(checkpoint string, report BackfillReport) {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	if _, err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != 3 || checkpoints[2] != "" {
+		t.Fatalf("Unexpected checkpoints %q", checkpoints)
+	}
+
+	// Resuming after the first page processes the remaining keys only.
+	b.Checkpoint = checkpoints[0]
+	report, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 2 || report.Migrated != 1 || report.Versions["colour_to_color"] != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	b.ListKeys = true
+	if _, err := b.Run(); err == nil {
+		t.Error("Expected resuming a key listing to fail")
+	}
+}
+
+func TestBackfillOnError(t *testing.T) {
+	b, storage := newGizmoBackfill(t)
+	b.ListKeys = true
+	b.Rate = 1e12
+	errFetch := errors.New("fetch failed")
+	storage.fail = map[string]error{"a": errFetch}
+	var failed []string
+	b.OnError = func(key string, err error) {
+		if err != errFetch {
+			t.Errorf("Unexpected error %v", err)
+		}
+		failed = append(failed, key)
+	}
+
+	report, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0] != "a" {
+		t.Errorf("Unexpected failed keys %v", failed)
+	}
+	if report.Keys != 3 || report.Failed != 1 || report.Migrated != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
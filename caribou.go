@@ -1,5 +1,12 @@
 package caribou
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
 // A Caribou is a data container that represents data at a certain version. Versions are strings
 // and every migration contains the destination version in addition to a function that performs
 // the data migration to the next version.
@@ -26,32 +33,337 @@ type Migration struct {
 	// Migrate is the transformation function that turns from its previous version to the version
 	// represented by this Migration.
 	Migrate func(map[string]interface{}) map[string]interface{}
+
+	// TryMigrate is used instead of Migrate by migrations that can fail, for example when they
+	// find malformed data. Only one of Migrate and TryMigrate should be set.
+	TryMigrate func(map[string]interface{}) (map[string]interface{}, error)
+
+	// Rollback is the optional inverse of Migrate. It turns data at the version represented by
+	// this Migration back into data at the previous version. A Migration without a Rollback is
+	// irreversible and blocks RewindMap from going past it.
+	Rollback func(map[string]interface{}) map[string]interface{}
+}
+
+// apply runs the migration on mp. Panics are recovered and returned as errors. If the migration
+// fails without returning a map, mp is returned as the partial result.
+func (m *Migration) apply(mp map[string]interface{}) (out map[string]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = mp
+			err = fmt.Errorf("Migration panicked: %v", r)
+		}
+	}()
+
+	switch {
+	case m.TryMigrate != nil:
+		out, err = m.TryMigrate(mp)
+	case m.Migrate != nil:
+		out = m.Migrate(mp)
+	default:
+		err = errors.New("Migration has no migrate function")
+	}
+	if out == nil {
+		out = mp
+	}
+	return
+}
+
+// rollback runs the migration's Rollback on mp. Panics are recovered and returned as errors, with
+// mp as the partial result.
+func (m *Migration) rollback(mp map[string]interface{}) (out map[string]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = mp
+			err = fmt.Errorf("Rollback panicked: %v", r)
+		}
+	}()
+
+	out = m.Rollback(mp)
+	if out == nil {
+		out = mp
+	}
+	return
+}
+
+// MigrationError is returned by FastForwardMap when a migration fails or panics, and by RewindMap
+// when a rollback panics.
+type MigrationError struct {
+	// FromVersion is the version the map had before fast forwarding or rewinding started.
+	FromVersion string
+
+	// Migration is the name of the migration that failed.
+	Migration string
+
+	// Map is the partially migrated map, as it was left by the failing migration.
+	Map map[string]interface{}
+
+	// Err is the error returned by the migration or the recovered panic.
+	Err error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("Migration %q from version %q failed: %v", e.Migration, e.FromVersion,
+		e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// IrreversibleMigrationError is returned by RewindMap when some of the migrations that would have
+// to be undone don't have a Rollback function.
+type IrreversibleMigrationError struct {
+	// Names of the irreversible migrations, newest first.
+	Names []string
+}
+
+func (e *IrreversibleMigrationError) Error() string {
+	return fmt.Sprintf("Irreversible migrations: %s", strings.Join(e.Names, ", "))
+}
+
+// ErrUnknownVersion is returned when a Caribou is at a version that doesn't match the name of any
+// of its migrations. This usually means the data was written by a newer binary or under a
+// migration that has since been renamed.
+var ErrUnknownVersion = errors.New("Unknown version")
+
+// UnknownVersionPolicy decides what FastForwardMap does with a Caribou at an unknown version.
+type UnknownVersionPolicy int
+
+const (
+	// UnknownVersionFail makes FastForwardMap return ErrUnknownVersion.
+	UnknownVersionFail UnknownVersionPolicy = iota
+
+	// UnknownVersionReadOnly leaves the map untouched as if it were at the latest version. The
+	// Caribou keeps its unknown version, which makes BuildMapOperation refuse to save it.
+	UnknownVersionReadOnly
+
+	// UnknownVersionReplay runs every migration from the start of the chain, as if the Caribou
+	// had no version at all.
+	UnknownVersionReplay
+)
+
+// DefaultUnknownVersionPolicy is used for every Caribou that doesn't implement
+// UnknownVersionPolicer.
+var DefaultUnknownVersionPolicy = UnknownVersionFail
+
+// An UnknownVersionPolicer is a Caribou that picks its own UnknownVersionPolicy.
+type UnknownVersionPolicer interface {
+	UnknownVersionPolicy() UnknownVersionPolicy
+}
+
+// unknownVersionPolicy returns the UnknownVersionPolicy that applies to c.
+func unknownVersionPolicy(c Caribou) UnknownVersionPolicy {
+	if p, ok := c.(UnknownVersionPolicer); ok {
+		return p.UnknownVersionPolicy()
+	}
+	return DefaultUnknownVersionPolicy
+}
+
+// checkKnownVersion returns an error wrapping ErrUnknownVersion if c is at a version that isn't
+// part of its migration chain. The empty version, which precedes the first migration, is known.
+func checkKnownVersion(c Caribou) error {
+	v := c.GetVersion()
+	if v != "" && migrationIndex(c.Migrations(), v) < 0 {
+		return fmt.Errorf("%w %q", ErrUnknownVersion, v)
+	}
+	return nil
+}
+
+// ErrVersionTooOld is returned when a Caribou is at a version older than its MinVersion and it
+// has no archived migrations to bring it up to date.
+var ErrVersionTooOld = errors.New("Version too old")
+
+// A MinVersioner is a Caribou whose oldest migrations have been retired, usually after a backfill
+// brought every stored map past them. MinVersion names the oldest version that can still be fast
+// forwarded. The names of the retired migrations up to and including MinVersion stay in
+// Migrations as markers, so that older versions are recognised as too old rather than unknown,
+// but their functions can be removed.
+type MinVersioner interface {
+	MinVersion() string
+}
+
+// An Archiver is a MinVersioner that can still migrate maps older than its MinVersion.
+// ArchivedMigrations returns the historical chain, which has to include MinVersion. It is only
+// used for maps below MinVersion, so it can live in a separate package that is rarely loaded.
+// Maps at versions the chain doesn't include still return ErrVersionTooOld.
+type Archiver interface {
+	ArchivedMigrations() []*Migration
+}
+
+// minVersion returns the MinVersion of c, or the empty version if c doesn't have one.
+func minVersion(c Caribou) string {
+	if mv, ok := c.(MinVersioner); ok {
+		return mv.MinVersion()
+	}
+	return ""
 }
 
 // FastForwardMap migrates the given map from current version of the Caribou to the latest
-// version.
+// version. The Caribou's version is advanced after every migration that succeeds. If a migration
+// fails or panics, a *MigrationError holding the partially migrated map is returned. A Caribou at
+// an unknown version is handled according to its UnknownVersionPolicy, and one older than its
+// MinVersion returns ErrVersionTooOld unless it is an Archiver.
 func FastForwardMap(c Caribou, mp map[string]interface{}) (map[string]interface{}, error) {
-	var fastFwd func(map[string]interface{}, string) (map[string]interface{}, error)
+	return fastForward(c, mp, len(c.Migrations())-1, true)
+}
+
+// FastForwardTo is like FastForwardMap but stops at the migration named target instead of going
+// all the way to the latest version. It returns an error if target isn't part of the migration
+// chain or if the Caribou is already past it.
+func FastForwardTo(c Caribou, mp map[string]interface{}, target string) (map[string]interface{},
+error) {
+	migrations := c.Migrations()
+	to := migrationIndex(migrations, target)
+	if to < 0 && target != "" {
+		return mp, fmt.Errorf("Unknown target version %q", target)
+	}
+	if checkKnownVersion(c) == nil && migrationIndex(migrations, c.GetVersion()) > to {
+		return mp, fmt.Errorf("Target version %q is behind version %q", target, c.GetVersion())
+	}
+	if min := minVersion(c); to < migrationIndex(migrations, min) {
+		return mp, fmt.Errorf("Target version %q is older than minimum version %q", target, min)
+	}
+
+	return fastForward(c, mp, to, true)
+}
 
-	fastFwd = func(mp map[string]interface{}, v string) (map[string]interface{}, error) {
-		// Return if there are no migrations or we are at the latest one.
-		if len(c.Migrations()) == 0 ||
-		c.Migrations()[len(c.Migrations())-1].Name == v {
+// fastForward runs the migrations following the Caribou's current version up to and including
+// the one at index to. If record is set, the run is reported to DefaultRecorder.
+func fastForward(c Caribou, mp map[string]interface{}, to int,
+record bool) (map[string]interface{}, error) {
+	migrations := c.Migrations()
+	from := c.GetVersion()
 
+	// Report the version the map came in at to the recorder, however far we get.
+	applied := 0
+	if recorder := DefaultRecorder; recorder != nil && record {
+		start := time.Now()
+		defer func() {
+			recorder.RecordMigration(caribouType(c), from, applied, time.Since(start))
+		}()
+	}
+
+	if err := checkKnownVersion(c); err != nil {
+		switch unknownVersionPolicy(c) {
+		case UnknownVersionReadOnly:
 			return mp, nil
+		case UnknownVersionReplay:
+			// migrationIndex returns -1 below, so the chain is replayed from the start.
+		default:
+			return mp, err
+		}
+	}
+
+	// Versions before the minimum version can only be migrated by the archived migrations, which
+	// bring them up to the minimum version.
+	start := migrationIndex(migrations, from)
+	if min := minVersion(c); start < migrationIndex(migrations, min) {
+		archiver, ok := c.(Archiver)
+		if !ok {
+			return mp, fmt.Errorf("%w %q", ErrVersionTooOld, from)
+		}
+		archived := archiver.ArchivedMigrations()
+		end := migrationIndex(archived, min)
+		if end < 0 {
+			return mp, fmt.Errorf("Archived migrations don't lead to minimum version %q", min)
+		}
+
+		// Known versions the archived migrations don't start from can't be brought up to date.
+		// Unknown versions only get here to be replayed from the start.
+		first := migrationIndex(archived, from)
+		if from != "" && first < 0 && checkKnownVersion(c) == nil {
+			return mp, fmt.Errorf("%w %q", ErrVersionTooOld, from)
+		}
+
+		var err error
+		mp, err = runMigrations(c, mp, archived, first+1, end, from, &applied)
+		if err != nil {
+			return mp, err
+		}
+		start = migrationIndex(migrations, min)
+	}
+
+	return runMigrations(c, mp, migrations, start+1, to, from, &applied)
+}
+
+// runMigrations applies migrations[first] through migrations[last] to mp, advancing the
+// Caribou's version and the applied count after each one.
+func runMigrations(c Caribou, mp map[string]interface{}, migrations []*Migration, first, last int,
+from string, applied *int) (map[string]interface{}, error) {
+
+	for i := first; i <= last; i++ {
+		migrated, err := migrations[i].apply(mp)
+		if err != nil {
+			return migrated, &MigrationError{from, migrations[i].Name, migrated, err}
+		}
+		mp = migrated
+		c.SetVersion(migrations[i].Name)
+		*applied++
+	}
+
+	return mp, nil
+}
+
+// RewindMap migrates the given map backwards from the current version of the Caribou to
+// targetVersion by running the Rollback of every migration in between, newest first. An empty
+// targetVersion rewinds to before the first migration. If any of those migrations is
+// irreversible the map is left untouched and an *IrreversibleMigrationError naming all of them is
+// returned. On success the Caribou is set to targetVersion. If a rollback panics, a
+// *MigrationError holding the partially rewound map is returned and the Caribou is left at the
+// version that map is at.
+func RewindMap(c Caribou, mp map[string]interface{}, targetVersion string) (map[string]interface{},
+error) {
+	migrations := c.Migrations()
+	from := migrationIndex(migrations, c.GetVersion())
+	to := migrationIndex(migrations, targetVersion)
+
+	if from < 0 && c.GetVersion() != "" {
+		return mp, fmt.Errorf("%w %q", ErrUnknownVersion, c.GetVersion())
+	}
+	if to < 0 && targetVersion != "" {
+		return mp, fmt.Errorf("Unknown target version %q", targetVersion)
+	}
+	if to > from {
+		return mp, fmt.Errorf("Target version %q is ahead of version %q", targetVersion,
+			c.GetVersion())
+	}
+
+	// Check the whole path before touching the map so that an irreversible rewind has no effect.
+	var irreversible []string
+	for i := from; i > to; i-- {
+		if migrations[i].Rollback == nil {
+			irreversible = append(irreversible, migrations[i].Name)
 		}
+	}
+	if len(irreversible) > 0 {
+		return mp, &IrreversibleMigrationError{irreversible}
+	}
 
-		// Otherwise migrate up and recurse on FastForward.
-		migrationIndex := -1
-		for i, v := range c.Migrations() {
-			if v.Name == c.GetVersion() {
-				migrationIndex = i
-				break
-			}
+	start := c.GetVersion()
+	for i := from; i > to; i-- {
+		rewound, err := migrations[i].rollback(mp)
+		if err != nil {
+			return rewound, &MigrationError{start, migrations[i].Name, rewound, err}
+		}
+		mp = rewound
+		if i > 0 {
+			c.SetVersion(migrations[i-1].Name)
+		} else {
+			c.SetVersion("")
 		}
-		c.Migrations()[migrationIndex+1].Migrate(mp)
-		return fastFwd(mp, c.Migrations()[migrationIndex+1].Name)
 	}
+	c.SetVersion(targetVersion)
+
+	return mp, nil
+}
 
-	return fastFwd(mp, c.GetVersion())
+// migrationIndex returns the position of the migration with the given name, or -1 if there is no
+// such migration.
+func migrationIndex(migrations []*Migration, name string) int {
+	for i, m := range migrations {
+		if m.Name == name {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,254 @@
+package caribou
+
+import (
+	"errors"
+	"testing"
+)
+
+type gadget struct {
+	ModelMetadata
+	migrations []*Migration
+}
+
+func (g *gadget) Migrations() []*Migration {
+	return g.migrations
+}
+
+func renameMigration(name, from, to string) *Migration {
+	return &Migration{
+		Name: name,
+		Migrate: func(m map[string]interface{}) map[string]interface{} {
+			m[to] = m[from]
+			delete(m, from)
+			return m
+		},
+		Rollback: func(m map[string]interface{}) map[string]interface{} {
+			m[from] = m[to]
+			delete(m, to)
+			return m
+		},
+	}
+}
+
+func TestRewindMap(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		renameMigration("b_to_c", "B", "C"),
+	}}
+	g.SetVersion("b_to_c")
+
+	m, err := RewindMap(g, map[string]interface{}{"C": "x"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["A"] != "x" || len(m) != 1 {
+		t.Errorf("Unexpected map %v", m)
+	}
+	if g.GetVersion() != "" {
+		t.Errorf("Unexpected version %q", g.GetVersion())
+	}
+}
+
+func TestRewindMapIrreversible(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		&Migration{Name: "drop_b", Migrate: func(m map[string]interface{}) map[string]interface{} {
+			delete(m, "B")
+			return m
+		}},
+	}}
+	g.SetVersion("drop_b")
+
+	_, err := RewindMap(g, map[string]interface{}{}, "")
+	irr, ok := err.(*IrreversibleMigrationError)
+	if !ok {
+		t.Fatalf("Expected IrreversibleMigrationError, got %v", err)
+	}
+	if len(irr.Names) != 1 || irr.Names[0] != "drop_b" {
+		t.Errorf("Unexpected irreversible migrations %v", irr.Names)
+	}
+	if g.GetVersion() != "drop_b" {
+		t.Errorf("Version changed after failed rewind: %q", g.GetVersion())
+	}
+}
+
+func TestRewindMapRecoversPanics(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		&Migration{
+			Name:     "explode",
+			Migrate:  func(m map[string]interface{}) map[string]interface{} { return m },
+			Rollback: func(m map[string]interface{}) map[string]interface{} { panic("boom") },
+		},
+		renameMigration("a_to_b", "A", "B"),
+	}}
+	g.SetVersion("a_to_b")
+
+	_, err := RewindMap(g, map[string]interface{}{"B": "x"}, "")
+	var me *MigrationError
+	if !errors.As(err, &me) {
+		t.Fatalf("Expected MigrationError, got %v", err)
+	}
+	if me.Migration != "explode" || me.FromVersion != "a_to_b" || me.Map["A"] != "x" {
+		t.Errorf("Unexpected error %+v", me)
+	}
+	if g.GetVersion() != "explode" {
+		t.Errorf("Expected the version of the partially rewound map, got %q", g.GetVersion())
+	}
+}
+
+func TestFastForwardMapMigrationError(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		&Migration{
+			Name: "parse_b",
+			TryMigrate: func(m map[string]interface{}) (map[string]interface{}, error) {
+				return nil, errors.New("B is malformed")
+			},
+		},
+		&Migration{Name: "never", Migrate: func(m map[string]interface{}) map[string]interface{} {
+			panic("unreachable")
+		}},
+	}}
+
+	_, err := FastForwardMap(g, map[string]interface{}{"A": "x"})
+	merr, ok := err.(*MigrationError)
+	if !ok {
+		t.Fatalf("Expected MigrationError, got %v", err)
+	}
+	if merr.FromVersion != "" || merr.Migration != "parse_b" || merr.Map["B"] != "x" {
+		t.Errorf("Unexpected error %#v", merr)
+	}
+	if g.GetVersion() != "a_to_b" {
+		t.Errorf("Unexpected version %q", g.GetVersion())
+	}
+}
+
+func TestFastForwardMapRecoversPanics(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		&Migration{Name: "explode", Migrate: func(m map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{"n": m["missing"].(int64) + 1}
+		}},
+	}}
+
+	_, err := FastForwardMap(g, map[string]interface{}{})
+	if merr, ok := err.(*MigrationError); !ok || merr.Migration != "explode" {
+		t.Errorf("Expected MigrationError from explode, got %v", err)
+	}
+}
+
+type futureGadget struct {
+	gadget
+	policy UnknownVersionPolicy
+}
+
+func (g *futureGadget) UnknownVersionPolicy() UnknownVersionPolicy {
+	return g.policy
+}
+
+func TestFastForwardMapUnknownVersion(t *testing.T) {
+	newFuture := func(policy UnknownVersionPolicy) *futureGadget {
+		g := &futureGadget{policy: policy}
+		g.migrations = []*Migration{renameMigration("a_to_b", "A", "B")}
+		g.SetVersion("b_to_c")
+		return g
+	}
+
+	g := newFuture(UnknownVersionFail)
+	_, err := FastForwardMap(g, map[string]interface{}{"C": "x"})
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Expected ErrUnknownVersion, got %v", err)
+	}
+
+	g = newFuture(UnknownVersionReadOnly)
+	m, err := FastForwardMap(g, map[string]interface{}{"C": "x"})
+	if err != nil || m["C"] != "x" || g.GetVersion() != "b_to_c" {
+		t.Errorf("Unexpected read-only result %v, %v, %q", m, err, g.GetVersion())
+	}
+
+	g = newFuture(UnknownVersionReplay)
+	m, err = FastForwardMap(g, map[string]interface{}{"A": "x"})
+	if err != nil || m["B"] != "x" || g.GetVersion() != "a_to_b" {
+		t.Errorf("Unexpected replay result %v, %v, %q", m, err, g.GetVersion())
+	}
+}
+
+func TestFastForwardTo(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		renameMigration("b_to_c", "B", "C"),
+		renameMigration("c_to_d", "C", "D"),
+	}}
+
+	m, err := FastForwardTo(g, map[string]interface{}{"A": "x"}, "b_to_c")
+	if err != nil || m["C"] != "x" || g.GetVersion() != "b_to_c" {
+		t.Errorf("Unexpected result %v, %v, %q", m, err, g.GetVersion())
+	}
+
+	if _, err = FastForwardTo(g, m, "a_to_b"); err == nil {
+		t.Error("Expected an error for a target behind the current version")
+	}
+	if _, err = FastForwardTo(g, m, "e_to_f"); err == nil {
+		t.Error("Expected an error for a target outside the chain")
+	}
+}
+
+type retiredGadget struct {
+	gadget
+	archived []*Migration
+}
+
+func (g *retiredGadget) MinVersion() string {
+	return "b_to_c"
+}
+
+type archivedGadget struct {
+	retiredGadget
+}
+
+func (g *archivedGadget) ArchivedMigrations() []*Migration {
+	return g.archived
+}
+
+func TestFastForwardMapMinVersion(t *testing.T) {
+	live := []*Migration{
+		&Migration{Name: "a_to_b"},
+		&Migration{Name: "b_to_c"},
+		renameMigration("c_to_d", "C", "D"),
+	}
+	archived := []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		renameMigration("b_to_c", "B", "C"),
+	}
+
+	g := &retiredGadget{}
+	g.migrations = live
+	if err := ValidateMigrations(g); err != nil {
+		t.Error(err)
+	}
+	g.SetVersion("a_to_b")
+	_, err := FastForwardMap(g, map[string]interface{}{"B": "x"})
+	if !errors.Is(err, ErrVersionTooOld) {
+		t.Errorf("Expected ErrVersionTooOld, got %v", err)
+	}
+
+	g.SetVersion("b_to_c")
+	m, err := FastForwardMap(g, map[string]interface{}{"C": "x"})
+	if err != nil || m["D"] != "x" {
+		t.Errorf("Unexpected result %v, %v", m, err)
+	}
+
+	a := &archivedGadget{}
+	a.migrations, a.archived = live, archived
+	m, err = FastForwardMap(a, map[string]interface{}{"A": "x"})
+	if err != nil || m["D"] != "x" || a.GetVersion() != "c_to_d" {
+		t.Errorf("Unexpected archived result %v, %v, %q", m, err, a.GetVersion())
+	}
+
+	// Versions the archived migrations don't cover aren't replayed from the start.
+	a.archived = archived[1:]
+	a.SetVersion("a_to_b")
+	m, err = FastForwardMap(a, map[string]interface{}{"B": "x"})
+	if !errors.Is(err, ErrVersionTooOld) || m["B"] != "x" || a.GetVersion() != "a_to_b" {
+		t.Errorf("Expected ErrVersionTooOld, got %v, %v, %q", m, err, a.GetVersion())
+	}
+}
@@ -0,0 +1,106 @@
+package caribou
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A Codec stores values of a Go type in registers. Encode turns a value into the contents of the
+// register and Decode turns them back into a value of the same type.
+type Codec struct {
+	Encode func(v interface{}) (string, error)
+	Decode func(s string) (interface{}, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[reflect.Type]Codec{
+		reflect.TypeOf(time.Duration(0)): {
+			Encode: func(v interface{}) (string, error) {
+				return v.(time.Duration).String(), nil
+			},
+			Decode: func(s string) (interface{}, error) {
+				return time.ParseDuration(s)
+			},
+		},
+	}
+)
+
+// RegisterCodec makes values of type t storable in registers. Types that implement
+// encoding.TextMarshaler and encoding.TextUnmarshaler, like time.Time, net.IP and *big.Int, don't
+// need a codec. A codec registered for such a type takes precedence over its text marshaling.
+func RegisterCodec(t reflect.Type, c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[t] = c
+}
+
+// codecFor returns the codec registered for t.
+func codecFor(t reflect.Type) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[t]
+	return c, ok
+}
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// hasCodec reports whether values of type t are stored in registers through a codec, either a
+// registered one or their text marshaling. Text marshaling only counts if t can be unmarshaled
+// too, directly or through a pointer, so that every register that is written can be loaded.
+func hasCodec(t reflect.Type) bool {
+	if t == nil {
+		return false
+	}
+	if _, ok := codecFor(t); ok {
+		return true
+	}
+	return t.Implements(textMarshalerType) &&
+		(t.Implements(textUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType))
+}
+
+// customRegister holds the contents of a register that was encoded by a codec. Those registers
+// don't say which type they hold, so they are decoded by decodeHook once the type of the field
+// they are loaded into is known. Unknown fields and interface{} values keep the customRegister,
+// which encodeRegister writes back unchanged.
+type customRegister string
+
+// encodeCustom encodes v with its codec.
+func encodeCustom(v interface{}) (string, error) {
+	if c, ok := codecFor(reflect.TypeOf(v)); ok {
+		return c.Encode(v)
+	}
+	if m, ok := v.(encoding.TextMarshaler); ok && hasCodec(reflect.TypeOf(v)) {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	return "", fmt.Errorf("Unsupported register type %T", v)
+}
+
+// decodeCustom decodes the contents of a register encoded by a codec into a value of type t.
+func decodeCustom(s string, t reflect.Type) (interface{}, error) {
+	if c, ok := codecFor(t); ok {
+		return c.Decode(s)
+	}
+
+	// Pointer types like *big.Int unmarshal into a new value of the type they point to, other
+	// types into a new pointer to a value of their own type.
+	if t.Kind() == reflect.Ptr && t.Implements(textUnmarshalerType) {
+		v := reflect.New(t.Elem())
+		err := v.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		return v.Interface(), err
+	}
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		v := reflect.New(t)
+		err := v.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		return v.Elem().Interface(), err
+	}
+
+	return nil, fmt.Errorf("No codec to decode a register into %s", t)
+}
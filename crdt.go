@@ -1,6 +1,7 @@
 package caribou
 
 import (
+	"fmt"
 	"reflect"
 	"errors"
 	riak "github.com/basho/riak-go-client"
@@ -8,111 +9,318 @@ import (
 
 // LoadRiakModel reads a riak.FetchMapResponse into the given model.
 func LoadRiakModel(r interface{}, m Model) error {
-	switch r.(type) {
+	_, err := loadRiakModel(r, m, 0)
+	return err
+}
+
+// loadRiakModel implements LoadRiakModel. With keepOriginal, the map as it was stored in Riak is
+// returned as well if the response had to be migrated.
+func loadRiakModel(r interface{}, m Model, flags loadFlags) (map[string]interface{}, error) {
+	var rm *riak.Map
+	var ctx []byte
+	switch r := r.(type) {
 	default:
-		return errors.New("Invalid response type")
+		return nil, errors.New("Invalid response type")
 	case *riak.FetchMapResponse:
-		// Convert the riak.Map CRDT data structure into a Go map.
-		gomap, err := RiakMapToMap(*r.(*riak.FetchMapResponse).Map)
-		if err != nil {
-			return err
-		}
+		rm, ctx = r.Map, r.Context
+	case *riak.UpdateMapResponse:
+		rm, ctx = r.Map, r.Context
+	}
 
-		// Load the Go map into the model.
-		err = LoadMapIntoModel(gomap, m)
-		if err != nil {
-			return err
-		}
+	// Convert the riak.Map CRDT data structure into a Go map.
+	gomap, err := RiakMapToMap(*rm)
+	if err != nil {
+		return nil, err
+	}
 
-		// Save the context.
-		m.SetContext(string(r.(*riak.FetchMapResponse).Context))
-		return nil
-	case *riak.UpdateMapResponse:
-		// Convert the riak.Map CRDT data structure into a Go map.
-		gomap, err := RiakMapToMap(*r.(*riak.UpdateMapResponse).Map)
-		if err != nil {
-			return err
+	// Load the Go map into the model.
+	original, err := loadMapIntoModel(gomap, m, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save the context.
+	m.SetContext(string(ctx))
+	return original, nil
+}
+
+// ErrKindChange is returned by BuildMapOperation for models in which fields have changed their
+// kind of CRDT, e.g. from a register to a map. Those changes take more than one map operation, see
+// BuildMapOperations.
+var ErrKindChange = errors.New("Fields changed their kind of CRDT")
+
+// BuildMapOperation builds a Riak CRDT MapOperation that is required to convert the model's
+// snapshot to it's current state. Fields in the snapshot that the model's struct doesn't declare
+// are left as they are. Models at an unknown version are read-only and return an error
+// wrapping ErrUnknownVersion, so that data written by a newer binary is never overwritten. If the
+// model is an Operator, its pending operations are added on top of the diff. Models in which
+// fields changed their kind of CRDT return ErrKindChange.
+func BuildMapOperation(m Model) (*riak.MapOperation, error) {
+	ops, err := BuildMapOperations(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) > 1 {
+		return nil, ErrKindChange
+	}
+	return ops[0], nil
+}
+
+// BuildMapOperations is BuildMapOperation for models in which fields may have changed their kind
+// of CRDT. Riak keeps a field of every kind under the same name, so the field of the old kind is
+// removed by a separate map operation that has to be applied first, and the next operation is
+// applied with the context returned by it. Without kind changes there is only one operation.
+// The two operations aren't applied atomically: if the second one fails, the field is gone from
+// the stored map while its new value was never written.
+func BuildMapOperations(m Model) ([]*riak.MapOperation, error) {
+	ops, err := buildMapOperations(m, m.GetSnapshot())
+	if err != nil {
+		return nil, err
+	}
+
+	if operator, ok := m.(Operator); ok {
+		err = operator.Operations().apply(ops[len(ops)-1])
+	}
+	return ops, err
+}
+
+// buildMapOperations is BuildMapOperations with the diff taken against from instead of the
+// snapshot. Unknown fields are still taken from the snapshot.
+func buildMapOperations(m Model, from map[string]interface{}) ([]*riak.MapOperation, error) {
+	if err := checkKnownVersion(m); err != nil {
+		return nil, err
+	}
+
+	to := ToMap(m, true)
+	err := encodeFields(to, reflect.ValueOf(m))
+	if err != nil {
+		return nil, err
+	}
+
+	// Carry over fields that the model doesn't declare so that they aren't removed.
+	snapshot := m.GetSnapshot()
+	unknown, err := unknownFields(snapshot, m)
+	if err != nil {
+		return nil, err
+	}
+	preserveUnknownFields(snapshot, to, unknown)
+
+	// Fields of the old kind are removed by a separate operation that is only created when a
+	// field changed its kind.
+	var op, retype *riak.MapOperation = &riak.MapOperation{}, nil
+	err = fillMapOp(wrapKinds(from, reflect.TypeOf(m)), to, op, func() *riak.MapOperation {
+		if retype == nil {
+			retype = &riak.MapOperation{}
 		}
+		return retype
+	})
+	if err != nil {
+		return nil, err
+	}
+	if retype != nil {
+		return []*riak.MapOperation{retype, op}, nil
+	}
+	return []*riak.MapOperation{op}, nil
+}
+
+// Counter is an int64 that is stored as a Riak counter instead of a register. Saving a model
+// increments the counter by its difference to the snapshot, so increments made concurrently by
+// different servers add up instead of overwriting each other.
+type Counter int64
+
+// crdtType is the kind of Riak CRDT that a Go value is stored as.
+type crdtType int
+
+const (
+	crdtNone crdtType = iota
+	crdtRegister
+	crdtFlag
+	crdtSet
+	crdtMap
+	crdtCounter
+)
+
+// crdtTypeOf returns the kind of CRDT that v is stored as, or crdtNone if v can't be stored.
+func crdtTypeOf(v interface{}) crdtType {
+	switch v := v.(type) {
+	case kindValue:
+		return v.kind
+	case Counter:
+		return crdtCounter
+	case []byte:
+		// Binary data is stored in a register rather than as a set of bytes.
+		return crdtRegister
+	}
+	if hasCodec(reflect.TypeOf(v)) {
+		return crdtRegister
+	}
 
-		// Load the Go map into the model.
-		err = LoadMapIntoModel(gomap, m)
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Bool:
+		return crdtFlag
+	case reflect.Map:
+		return crdtMap
+	case reflect.Slice, reflect.Array:
+		return crdtSet
+	case reflect.String, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32,
+		reflect.Float64:
+		return crdtRegister
+	}
+	return crdtNone
+}
+
+// setMembers returns the raw members of a set value. Strings and byte slices are stored as they
+// are, any other element type is encoded with encodeRegister.
+func setMembers(v interface{}) ([][]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, errors.New("Unsupported set type")
+	}
+
+	members := make([][]byte, rv.Len())
+	for i := range members {
+		member, err := encodeSetMember(rv.Index(i).Interface())
 		if err != nil {
-			return err
+			return nil, err
 		}
+		members[i] = member
+	}
+	return members, nil
+}
+
+// encodeSetMember encodes a single set member.
+func encodeSetMember(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	}
+
+	encoded, err := encodeRegister(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
 
-		// Save the context.
-		m.SetContext(string(r.(*riak.UpdateMapResponse).Context))
-		return nil
+// counterValue returns the value of a counter field, which may be a Counter or any other
+// integer type tagged as a counter.
+func counterValue(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
 	}
+	return 0, false
 }
 
-// BuildMapOperation builds a Riak CRDT MapOperation that is required to convert the model's
-// snapshot to it's current state.
-func BuildMapOperation(m Model) (*riak.MapOperation, error) {
-	var op riak.MapOperation
-	from := m.GetSnapshot()
-	to := ToMap(m, true)
-	err := fillMapOp(from, to, &op)
-	return &op, err
+// isNil reports whether v is nil or a nil pointer. Both mean that a field isn't set.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
 }
 
-// Recursive helper function for BuildMapOperation.
-func fillMapOp(from map[string]interface{}, to map[string]interface{},
-op *riak.MapOperation) error {
+// Recursive helper function for BuildMapOperations. Fields that changed their kind are removed
+// from the operation returned by retype, everything else is written to op.
+func fillMapOp(from map[string]interface{}, to map[string]interface{}, op *riak.MapOperation,
+retype func() *riak.MapOperation) error {
 
-	// Remove fields that exist in `from` but not in `to`.
+	// Remove fields that exist in `from` but not in `to`, or only as another kind. Nil values
+	// count as missing.
 	for k, v := range from {
-		if to[k] == nil || reflect.ValueOf(v).Kind() != reflect.ValueOf(to[k]).Kind() {
-			switch reflect.ValueOf(v).Kind() {
-			case reflect.Bool:
-				op.RemoveFlag(k)
-			case reflect.Map:
-				op.RemoveMap(k)
-			case reflect.Slice, reflect.Array:
-				op.RemoveSet(k)
-			case reflect.String, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-				reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32,
-				reflect.Float64:
-				op.RemoveRegister(k)
-			}
+		if !isNil(to[k]) && crdtTypeOf(v) == crdtTypeOf(to[k]) {
+			continue
+		}
+		target := op
+		if !isNil(to[k]) {
+			target = retype()
+		}
+		switch crdtTypeOf(v) {
+		case crdtFlag:
+			target.RemoveFlag(k)
+		case crdtMap:
+			target.RemoveMap(k)
+		case crdtSet:
+			target.RemoveSet(k)
+		case crdtRegister:
+			target.RemoveRegister(k)
+		case crdtCounter:
+			target.RemoveCounter(k)
 		}
 	}
 
-	// Set fields.
-	for k, v := range to {
-		switch reflect.ValueOf(v).Kind() {
+	// Set fields. Values whose kind was chosen by a struct tag are unwrapped first.
+	for k, tv := range to {
+		if isNil(tv) {
+			continue
+		}
+		v, prev := unwrapKind(tv), unwrapKind(from[k])
+		switch crdtTypeOf(tv) {
 		default:
-			return errors.New("Unrecognized field type")
-		case reflect.Map:
+			return fmt.Errorf("Unrecognized type for field %q", k)
+		case crdtCounter:
+			// Counters are incremented by the difference to the snapshot.
+			n, ok := counterValue(v)
+			if !ok {
+				return fmt.Errorf("Field %q can't be stored as a counter", k)
+			}
+			var p int64
+			if crdtTypeOf(from[k]) == crdtCounter {
+				p, _ = counterValue(prev)
+			}
+			if delta := n - p; delta != 0 {
+				op.IncrementCounter(k, delta)
+			}
+		case crdtMap:
 			// Maps are handled recursively.
-			if reflect.ValueOf(from[k]).Kind() == reflect.Map {
-				fillMapOp(from[k].(map[string]interface{}), v.(map[string]interface{}), op.Map(k))
-			} else {
-				fillMapOp(map[string]interface{}{}, v.(map[string]interface{}), op.Map(k))
+			vm, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("Field %q can't be stored as a map", k)
 			}
-		case reflect.Slice, reflect.Array:
-			// If both the new and previous values are arrays then diff the arrays as sets and
-			// register the necessary AddToSet and RemoveFromSets operations.
-			fromArr := []string{}
-			if reflect.ValueOf(from[k]).Kind() == reflect.Slice ||
-			reflect.ValueOf(from[k]).Kind() == reflect.Array {
-				fromArr = from[k].([]string)
+			pm, ok := prev.(map[string]interface{})
+			if !ok || crdtTypeOf(from[k]) != crdtMap {
+				pm = map[string]interface{}{}
+			}
+			nestedRetype := func() *riak.MapOperation { return retype().Map(k) }
+			if err := fillMapOp(pm, vm, op.Map(k), nestedRetype); err != nil {
+				return fmt.Errorf("Field %q: %w", k, err)
+			}
+		case crdtSet:
+			// If both the new and previous values are sets then diff them and register the
+			// necessary AddToSet and RemoveFromSets operations.
+			var fromMembers [][]byte
+			if crdtTypeOf(from[k]) == crdtSet {
+				members, err := setMembers(prev)
+				if err != nil {
+					return err
+				}
+				fromMembers = members
+			}
+			toMembers, err := setMembers(v)
+			if err != nil {
+				return err
 			}
 
-			// Build maps of item => true for both arrays. Only supports string lists.
-			// TODO(lopatin): Detect if this is a byte array, and return an error because it is
-			// not supported. Or you know ... add support for byte arrays.
+			// Build maps of item => true for both sets. Sets can't hold duplicates, so refuse to
+			// drop them silently.
 			mv := make(map[string]bool)
 			mf := make(map[string]bool)
-			for _, s := range v.([]string) {
-				if reflect.ValueOf(s).Kind() == reflect.String {
-					mv[s] = true
+			for _, member := range toMembers {
+				if mv[string(member)] {
+					return fmt.Errorf("Field %q has duplicate items; tag it `caribou:\",list\"` "+
+						"to keep them", k)
 				}
+				mv[string(member)] = true
 			}
-			for _, s := range fromArr {
-				if reflect.ValueOf(s).Kind() == reflect.String {
-					mf[s] = true
-				}
+			for _, member := range fromMembers {
+				mf[string(member)] = true
 			}
 
 			// Remove items from set if they don't exist in the target.
@@ -128,11 +336,13 @@ op *riak.MapOperation) error {
 					op.AddToSet(k, []byte(key))
 				}
 			}
-		case reflect.Bool:
-			op.SetFlag(k, v.(bool))
-		case reflect.String, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-			reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32,
-			reflect.Float64:
+		case crdtFlag:
+			b, ok := v.(bool)
+			if !ok {
+				return fmt.Errorf("Field %q can't be stored as a flag", k)
+			}
+			op.SetFlag(k, b)
+		case crdtRegister:
 			reg, err := encodeRegister(v)
 			if err != nil {
 				return err
@@ -145,17 +355,25 @@ op *riak.MapOperation) error {
 }
 
 // RiakMapToMap converts a riak.Map CRDT struct to a plain Go map. Nested maps are handled
-// recursively. Counters are ignored because our data model doesn't support them. This function
-// also tries to decode registers into numbers and only treats them as strings if decoding fails.
+// recursively and counters are returned as Counter values. This function also tries to decode
+// registers into numbers or binary data and only treats them as strings if decoding fails. Sets
+// are returned as string slices of raw members, which LoadMapIntoModel decodes according to the
+// element type of the model's field.
 func RiakMapToMap(rm riak.Map) (map[string]interface{}, error) {
 	// Create a new empty map.
-	gm := make(map[string]interface{})
+	gm := make(map[string]interface{}, len(rm.Counters)+len(rm.Sets)+len(rm.Flags)+
+		len(rm.Registers)+len(rm.Maps))
+
+	// Copy over the counters.
+	for k, v := range rm.Counters {
+		gm[k] = Counter(v)
+	}
 
 	// Copy over the sets. Convert v from [][]byte to []string.
 	for k, v := range rm.Sets {
-		vs := []string{}
-		for _, item := range v {
-			vs = append(vs, string(item))
+		vs := make([]string, len(v))
+		for i, item := range v {
+			vs[i] = string(item)
 		}
 		gm[k] = vs
 	}
@@ -186,48 +404,197 @@ func RiakMapToMap(rm riak.Map) (map[string]interface{}, error) {
 	return gm, nil
 }
 
-// StoreModelInRiak saves the model in Riak using CRDT map operations.
-func StoreModelInRiak(model Model, bucketName, key string, rs *RiakService) error {
-	// Build the update map CRDT operation.
-	op, err := BuildMapOperation(model)
-	if err != nil {
-		return err
+// hasLegacyRegisters reports whether any register in rm, including those of nested maps, was
+// written in the legacy register encoding.
+func hasLegacyRegisters(rm *riak.Map) bool {
+	for _, v := range rm.Registers {
+		if isLegacyRegister(string(v)) {
+			return true
+		}
 	}
+	for _, nested := range rm.Maps {
+		if hasLegacyRegisters(nested) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Build the update command.
-	builder := riak.NewUpdateMapCommandBuilder().
-	WithBucket(bucketName).
-	WithBucketType(BucketTypeMaps).
-	WithKey(key).
-	WithReturnBody(true).
-	WithMapOperation(op)
+// A RiakExecutor runs functions that execute commands with a riak.Client. *RiakService is the
+// RiakExecutor used against a cluster; riaktest.Server is one for tests.
+type RiakExecutor interface {
+	Exec(f func(client *riak.Client) error) error
+}
 
-	// Attach context
-	ctx := model.GetContext()
-	if len(ctx) > 0 {
-		builder.WithContext([]byte(ctx))
-	}
+// StoreModelInRiak saves the model in Riak using CRDT map operations. Pending operations of an
+// Operator are reset once they have been stored. Updates that take more than one map operation,
+// see BuildMapOperations, aren't atomic: if a later operation fails, the earlier ones stay
+// applied. The model's context and snapshot are then set to the map as they left it, so that
+// saving the model again completes the update.
+func StoreModelInRiak(model Model, bucketName, key string, rs RiakExecutor) error {
+	return storeModel(model, riakMapUpdater(bucketName, key, true, rs))
+}
 
-	updateMapCmd, err := builder.Build()
+// A mapUpdater applies a map operation with the given context to a stored map. The response,
+// which carries the new context and map, may be nil for the last operation of an update.
+type mapUpdater func(op *riak.MapOperation, ctx string, last bool) (*riak.UpdateMapResponse, error)
+
+// storeModel implements StoreModelInRiak with the given updater.
+func storeModel(model Model, update mapUpdater) error {
+	// Build the update map CRDT operations.
+	ops, err := BuildMapOperations(model)
 	if err != nil {
 		return err
 	}
 
-	// Run the command.
-	err = rs.Exec(func(client *riak.Client) error {
-		return client.Execute(updateMapCmd)
-	})
+	// Run the update.
+	resp, err := applyMapOperations(ops, model.GetContext(), update)
 	if err != nil {
+		// Only the first operation went through. It removed the fields of the old kind, which
+		// therefore aren't part of the snapshot anymore. The model's fields are kept.
+		if resp != nil {
+			retype := reflect.ValueOf(ops[0]).Elem()
+			model.SetSnapshot(withoutRemovedFields(model.GetSnapshot(), retype))
+			model.SetContext(string(resp.Context))
+		}
 		return err
 	}
 
-	// Load the response into the model.
-	cmd := updateMapCmd.(*riak.UpdateMapCommand)
-	return LoadRiakModel(cmd.Response, model)
+	// The pending operations are part of the stored map now.
+	if operator, ok := model.(Operator); ok {
+		operator.ResetOperations()
+	}
+
+	// Load the response into the model. It was read when the model was loaded, so it isn't
+	// recorded again.
+	_, err = loadRiakModel(resp, model, reload)
+	return err
+}
+
+// withoutRemovedFields returns a copy of m without the fields that op, a riak.MapOperation,
+// removes. The operation's fields aren't exported, so they are read with reflection.
+func withoutRemovedFields(m map[string]interface{}, op reflect.Value) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+
+	for _, name := range []string{
+		"removeCounters", "removeSets", "removeRegisters", "removeFlags", "removeMaps",
+	} {
+		for _, k := range op.FieldByName(name).MapKeys() {
+			delete(out, k.String())
+		}
+	}
+
+	// Fields of nested maps are removed by nested operations.
+	nested := op.FieldByName("maps")
+	for _, k := range nested.MapKeys() {
+		if nm, ok := out[k.String()].(map[string]interface{}); ok {
+			out[k.String()] = withoutRemovedFields(nm, nested.MapIndex(k).Elem())
+		}
+	}
+	return out
+}
+
+// updateRiakMap applies the map operations to the Riak map with the given key, see
+// applyMapOperations.
+func updateRiakMap(ops []*riak.MapOperation, bucketName, key, ctx string, returnBody bool,
+rs RiakExecutor) (*riak.UpdateMapResponse, error) {
+	return applyMapOperations(ops, ctx, riakMapUpdater(bucketName, key, returnBody, rs))
+}
+
+// riakMapUpdater returns a mapUpdater for the Riak map with the given key. Operations before the
+// last one always return the body to get the context for the next one.
+func riakMapUpdater(bucketName, key string, returnBody bool, rs RiakExecutor) mapUpdater {
+	return func(op *riak.MapOperation, ctx string, last bool) (*riak.UpdateMapResponse, error) {
+		// Build the update command.
+		builder := riak.NewUpdateMapCommandBuilder().
+		WithBucket(bucketName).
+		WithBucketType(BucketTypeMaps).
+		WithKey(key).
+		WithReturnBody(returnBody || !last).
+		WithMapOperation(op)
+
+		// Attach context
+		if len(ctx) > 0 {
+			builder.WithContext([]byte(ctx))
+		}
+
+		cmd, err := builder.Build()
+		if err != nil {
+			return nil, err
+		}
+
+		// Run the command.
+		err = rs.Exec(func(client *riak.Client) error {
+			return client.Execute(cmd)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cmd.(*riak.UpdateMapCommand).Response, nil
+	}
+}
+
+// applyMapOperations applies the map operations one after the other. Every operation after the
+// first is applied with the context returned by the previous one. The response of the last
+// operation is returned. If a later operation fails, the response of the one before it is
+// returned with the error, since the operations before it stay applied.
+func applyMapOperations(ops []*riak.MapOperation, ctx string,
+update mapUpdater) (*riak.UpdateMapResponse, error) {
+
+	var resp *riak.UpdateMapResponse
+	for i, op := range ops {
+		next, err := update(op, ctx, i == len(ops)-1)
+		if err != nil {
+			if i > 0 {
+				return resp, fmt.Errorf("Step %d of %d of the update: %w", i+1, len(ops), err)
+			}
+			return nil, err
+		}
+
+		resp = next
+		if resp != nil {
+			ctx = string(resp.Context)
+		}
+	}
+
+	return resp, nil
 }
 
 // FindRiakModelByKey finds the Riak map with the given key and loads it into the specified model.
-func FindRiakModelByKey(model Model, bucketName, key string, rs *RiakService) (bool, error) {
+// If the map had to be migrated and DefaultWriteBack is set, the migrated map is also written
+// back to Riak in the background.
+func FindRiakModelByKey(model Model, bucketName, key string, rs RiakExecutor) (bool, error) {
+	resp, err := fetchRiakMap(bucketName, key, rs)
+	if err != nil || resp == nil {
+		return false, err
+	}
+
+	// Load the map, keeping the stored version around if it has to be written back.
+	wb := DefaultWriteBack
+	var flags loadFlags
+	if wb != nil {
+		flags = keepOriginal
+	}
+	original, err := loadRiakModel(resp, model, flags)
+	if err != nil {
+		return true, err
+	}
+	if wb != nil && original != nil {
+		wb.schedule(model, original, bucketName, key,
+			func(ops []*riak.MapOperation, ctx string) error {
+				_, err := updateRiakMap(ops, bucketName, key, ctx, false, rs)
+				return err
+			})
+	}
+	return true, nil
+}
+
+// fetchRiakMap fetches the Riak map with the given key. A nil response is returned if the map
+// doesn't exist.
+func fetchRiakMap(bucketName, key string, rs RiakExecutor) (*riak.FetchMapResponse, error) {
 	// Create the command that will fetch the user map from Riak.
 	cmd, err := riak.NewFetchMapCommandBuilder().
 	WithBucket(bucketName).
@@ -235,7 +602,7 @@ func FindRiakModelByKey(model Model, bucketName, key string, rs *RiakService) (b
 	WithKey(key).
 	Build()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	// Run the command
@@ -243,17 +610,55 @@ func FindRiakModelByKey(model Model, bucketName, key string, rs *RiakService) (b
 		return client.Execute(cmd)
 	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	// Check if not found
 	fetchMapCmd := cmd.(*riak.FetchMapCommand)
 	if fetchMapCmd.Response.IsNotFound || fetchMapCmd.Response.Map == nil {
-		return false, nil
+		return nil, nil
+	}
+	return fetchMapCmd.Response, nil
+}
+
+// DeleteRiakModel deletes the Riak map with the given key. A model with a context is only deleted
+// if the map wasn't updated since the context was issued, otherwise an error wrapping
+// ErrStaleContext is returned. The model's snapshot and context are cleared, so that saving it
+// again creates a new map.
+func DeleteRiakModel(model Model, bucketName, key string, rs RiakExecutor) error {
+	// Riak deletes don't take a map context, so compare it with the stored one first. Updates
+	// made between the fetch and the delete are still lost.
+	if ctx := model.GetContext(); ctx != "" {
+		resp, err := fetchRiakMap(bucketName, key, rs)
+		if err != nil {
+			return err
+		}
+		if resp != nil && string(resp.Context) != ctx {
+			return fmt.Errorf("%w for key %q", ErrStaleContext, key)
+		}
+	}
+
+	// Create the command that will delete the map.
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+	WithBucket(bucketName).
+	WithBucketType(BucketTypeMaps).
+	WithKey(key).
+	Build()
+	if err != nil {
+		return err
 	}
 
-	// Load the map
-	return true, LoadRiakModel(fetchMapCmd.Response, model)
+	// Run the command
+	err = rs.Exec(func(client *riak.Client) error {
+		return client.Execute(cmd)
+	})
+	if err != nil {
+		return err
+	}
+
+	model.SetSnapshot(nil)
+	model.SetContext("")
+	return nil
 }
 
 type Contexter interface {
@@ -0,0 +1,230 @@
+package caribou
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+func TestRiakMapToMapCounters(t *testing.T) {
+	m, err := RiakMapToMap(riak.Map{
+		Counters: map[string]int64{"Clicks": 42},
+		Maps: map[string]*riak.Map{
+			"Daily": &riak.Map{Counters: map[string]int64{"Monday": 7}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["Clicks"] != Counter(42) {
+		t.Errorf("Unexpected counter %#v", m["Clicks"])
+	}
+	if m["Daily"].(map[string]interface{})["Monday"] != Counter(7) {
+		t.Errorf("Unexpected nested counter %#v", m["Daily"])
+	}
+}
+
+func TestFillMapOpKindChange(t *testing.T) {
+	from := map[string]interface{}{
+		"Address": "1 Main Street",
+		"Name":    "Ann",
+		"Nested":  map[string]interface{}{"Score": int64(3)},
+	}
+	to := map[string]interface{}{
+		"Address": map[string]interface{}{"Street": "Main Street", "Number": int64(1)},
+		"Nested":  map[string]interface{}{"Score": Counter(3)},
+	}
+
+	// Store the old map first.
+	store := NewMemoryStore()
+	var create riak.MapOperation
+	err := fillMapOp(map[string]interface{}{}, from, &create, func() *riak.MapOperation {
+		t.Fatal("Unexpected kind change")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Apply("k", &create); err != nil {
+		t.Fatal(err)
+	}
+
+	var op riak.MapOperation
+	retype := &riak.MapOperation{}
+	if err := fillMapOp(from, to, &op, func() *riak.MapOperation { return retype }); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []*riak.MapOperation{retype, &op} {
+		if _, err := store.Apply("k", op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Address changed kind at the top level and Score inside Nested. Name was simply removed.
+	rm, _, _ := store.Fetch("k")
+	if len(rm.Registers) != 0 || len(rm.Maps) != 2 {
+		t.Fatalf("Unexpected map %+v", rm)
+	}
+	address := rm.Maps["Address"]
+	street, _ := decodeRegister(string(address.Registers["Street"]))
+	if len(address.Registers) != 2 || street != "Main Street" {
+		t.Errorf("Unexpected Address %+v", address)
+	}
+	nested := rm.Maps["Nested"]
+	if len(nested.Registers) != 0 || nested.Counters["Score"] != 3 {
+		t.Errorf("Unexpected Nested %+v", nested)
+	}
+}
+
+func TestFillMapOpNestedError(t *testing.T) {
+	to := map[string]interface{}{
+		"Nested": map[string]interface{}{"Broken": complex(1, 2)},
+	}
+	var op riak.MapOperation
+	err := fillMapOp(map[string]interface{}{}, to, &op, func() *riak.MapOperation {
+		return &riak.MapOperation{}
+	})
+	if err == nil {
+		t.Error("Expected the error of the nested map to be returned")
+	}
+}
+
+func TestStoreModelFailingStep(t *testing.T) {
+	// Opens used to be stored as a register.
+	store := NewMemoryStore()
+	var create riak.MapOperation
+	old := map[string]interface{}{"Email": "ann@example.com", "Opens": int64(2)}
+	err := fillMapOp(map[string]interface{}{}, old, &create, func() *riak.MapOperation {
+		t.Fatal("Unexpected kind change")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Apply("ann", &create); err != nil {
+		t.Fatal(err)
+	}
+	var s Subscriber
+	if _, err := store.Find(&s, "ann"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The register is removed by the first step, but the counter is never written.
+	unavailable := errors.New("Unavailable")
+	steps := 0
+	err = storeModel(&s, func(op *riak.MapOperation, ctx string,
+	last bool) (*riak.UpdateMapResponse, error) {
+		if steps++; steps == 2 {
+			return nil, unavailable
+		}
+		return store.updater("ann")(op, ctx, last)
+	})
+	if !errors.Is(err, unavailable) || !strings.HasPrefix(err.Error(), "Step 2 of 2") {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	rm, ctx, _ := store.Fetch("ann")
+	if _, ok := rm.Registers["Opens"]; ok || len(rm.Counters) != 0 {
+		t.Fatalf("Unexpected map %+v", rm)
+	}
+
+	// The model picks up from the first step and keeps its fields.
+	if s.GetContext() != string(ctx) {
+		t.Errorf("Expected context %q, got %q", ctx, s.GetContext())
+	}
+	snapshot := s.GetSnapshot()
+	if _, ok := snapshot["Opens"]; ok || snapshot["Email"] != "ann@example.com" {
+		t.Errorf("Unexpected snapshot %#v", snapshot)
+	}
+	if s.Opens != 2 {
+		t.Errorf("Unexpected model %+v", s)
+	}
+
+	// Saving again writes the counter.
+	if err := store.Save(&s, "ann"); err != nil {
+		t.Fatal(err)
+	}
+	rm, _, _ = store.Fetch("ann")
+	if rm.Counters["Opens"] != 2 || rm.Registers["Email"] == nil {
+		t.Errorf("Unexpected map %+v", rm)
+	}
+}
+
+// benchmarkMap returns a riak.Map the size of a typical model: a few dozen registers, some sets,
+// counters and flags, and a handful of nested maps laid out the same way.
+func benchmarkMap(depth int) *riak.Map {
+	rm := &riak.Map{
+		Counters:  make(map[string]int64),
+		Sets:      make(map[string][][]byte),
+		Registers: make(map[string][]byte),
+		Flags:     make(map[string]bool),
+		Maps:      make(map[string]*riak.Map),
+	}
+	for i := 0; i < 40; i++ {
+		k := fmt.Sprintf("Register%d", i)
+		var v interface{} = fmt.Sprintf("value %d", i)
+		if i%2 == 0 {
+			v = int64(i * 1000)
+		}
+		reg, _ := encodeRegister(v)
+		rm.Registers[k] = []byte(reg)
+	}
+	for i := 0; i < 5; i++ {
+		members := make([][]byte, 20)
+		for j := range members {
+			members[j] = []byte(fmt.Sprintf("member %d", j))
+		}
+		rm.Sets[fmt.Sprintf("Set%d", i)] = members
+		rm.Counters[fmt.Sprintf("Counter%d", i)] = int64(i)
+		rm.Flags[fmt.Sprintf("Flag%d", i)] = i%2 == 0
+	}
+	if depth > 0 {
+		for i := 0; i < 5; i++ {
+			rm.Maps[fmt.Sprintf("Map%d", i)] = benchmarkMap(depth - 1)
+		}
+	}
+	return rm
+}
+
+func BenchmarkRiakMapToMap(b *testing.B) {
+	rm := benchmarkMap(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := RiakMapToMap(*rm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFillMapOp(b *testing.B) {
+	from, err := RiakMapToMap(*benchmarkMap(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	to, err := RiakMapToMap(*benchmarkMap(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Change a few fields, as a typical save does.
+	to["Register1"] = "changed"
+	to["Counter0"] = Counter(10)
+	to["Set0"] = []string{"member 0", "new member"}
+	to["Map0"].(map[string]interface{})["Flag1"] = true
+
+	retype := func() *riak.MapOperation {
+		b.Fatal("Unexpected kind change")
+		return nil
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var op riak.MapOperation
+		if err := fillMapOp(from, to, &op, retype); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,155 +3,166 @@ package caribou
 import (
 	"errors"
 	"fmt"
-	"reflect"
-	"regexp"
 	"strconv"
+	"strings"
 )
 
-// encodeRegister encodes number types into a string so that the value can later be decoded into
-// it's original Golang type. If a string is passed in, then it is returned as-is.
-func encodeRegister(number interface{}) (encoded string, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			encoded = ""
-			err = errors.New("Could not decode register")
-		}
-	}()
+// registerPrefix starts every register written in the current encoding. Registers without it
+// were written in the legacy encoding, in which strings were stored as-is and could be mistaken
+// for encoded numbers.
+const registerPrefix = "\x01"
 
-	switch number.(type) {
+// encodeRegister encodes a value into a string so that it can later be decoded into it's original
+// Golang type. The encoding is the register prefix, a type tag, a colon and the value, e.g.
+// "\x01i64:5" or "\x01s:hello". Strings and binary data follow the colon as-is, so they can never
+// be mistaken for another type. Other types are encoded by their Codec.
+func encodeRegister(number interface{}) (encoded string, err error) {
+	switch n := number.(type) {
 	default:
-		encoded = number.(string)
+		// Other types are encoded by their codec and decoded according to the field type.
+		var custom string
+		custom, err = encodeCustom(number)
+		if err == nil {
+			encoded = registerPrefix + "c:" + custom
+		}
 	case int, uint, uintptr:
 		// Don't allow implementation specific number types.
 		err = errors.New("Implementation specific number types are not allowed.")
 	case complex64, complex128:
 		err = errors.New("Complex numbers aren't supported. Why are you using complex numbers?")
-	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
-		encoded = fmt.Sprintf("%s(%d)", reflect.TypeOf(number), number)
+	case string:
+		encoded = registerPrefix + "s:" + n
+	case customRegister:
+		// Registers of unknown fields are written back without being decoded.
+		encoded = registerPrefix + "c:" + string(n)
+	case []byte:
+		encoded = registerPrefix + "b:" + string(n)
+	case bool:
+		// Only bools tagged as registers get here, the rest are stored as flags.
+		encoded = registerPrefix + "t:" + strconv.FormatBool(n)
+	case int8:
+		encoded = registerPrefix + "i8:" + strconv.FormatInt(int64(n), 10)
+	case int16:
+		encoded = registerPrefix + "i16:" + strconv.FormatInt(int64(n), 10)
+	case int32:
+		encoded = registerPrefix + "i32:" + strconv.FormatInt(int64(n), 10)
+	case int64:
+		encoded = registerPrefix + "i64:" + strconv.FormatInt(n, 10)
+	case uint8:
+		encoded = registerPrefix + "u8:" + strconv.FormatUint(uint64(n), 10)
+	case uint16:
+		encoded = registerPrefix + "u16:" + strconv.FormatUint(uint64(n), 10)
+	case uint32:
+		encoded = registerPrefix + "u32:" + strconv.FormatUint(uint64(n), 10)
+	case uint64:
+		encoded = registerPrefix + "u64:" + strconv.FormatUint(n, 10)
 	case float32:
-		encoded = fmt.Sprintf("float32(%s)", strconv.FormatFloat(float64(number.(float32)), 'E', -1, 32))
+		encoded = registerPrefix + "f32:" + strconv.FormatFloat(float64(n), 'E', -1, 32)
 	case float64:
-		encoded = fmt.Sprintf("float64(%s)", strconv.FormatFloat(number.(float64), 'E', -1, 64))
+		encoded = registerPrefix + "f64:" + strconv.FormatFloat(n, 'E', -1, 64)
 	}
 	return
 }
 
-// decodeRegister is the opposite of encodeRegister. It tries to parse out a number type from the
-// given string according to our number encoding format. If decoding is not possible, the input is
-// returned as-is.
-func decodeRegister(str string) (interface{}, error) {
-	var r *regexp.Regexp
-	var matches []string
-
-	// Decode int8
-	r, _ = regexp.Compile("^int8\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseInt(matches[1], 10, 8)
-		if err != nil {
-			return str, err
-		}
-		return int8(result), nil
-	}
-
-	// Decode int16
-	r, _ = regexp.Compile("^int16\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseInt(matches[1], 10, 16)
-		if err != nil {
-			return str, err
-		}
-		return int16(result), nil
-	}
+// isLegacyRegister reports whether the register was written in the legacy encoding.
+func isLegacyRegister(str string) bool {
+	return !strings.HasPrefix(str, registerPrefix)
+}
 
-	// Decode int32
-	r, _ = regexp.Compile("^int32\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseInt(matches[1], 10, 32)
-		if err != nil {
-			return str, err
-		}
-		return int32(result), nil
+// decodeCurrentRegister decodes a register in the current encoding, without the prefix.
+func decodeCurrentRegister(str string) (interface{}, error) {
+	colon := strings.IndexByte(str, ':')
+	if colon < 0 {
+		return nil, fmt.Errorf("Malformed register %q", str)
 	}
+	tag, value := str[:colon], str[colon+1:]
 
-	// Decode int64
-	r, _ = regexp.Compile("^int64\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseInt(matches[1], 10, 64)
-		if err != nil {
-			return str, err
-		}
-		return int64(result), nil
+	switch tag {
+	case "s":
+		return value, nil
+	case "c":
+		return customRegister(value), nil
+	case "b":
+		return []byte(value), nil
+	case "t":
+		return strconv.ParseBool(value)
 	}
+	return decodeNumber(tag, value)
+}
 
-	// Decode uint8
-	r, _ = regexp.Compile("^uint8\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseUint(matches[1], 10, 8)
-		if err != nil {
-			return str, err
-		}
-		return uint8(result), nil
+// decodeNumber parses a number register with the given type tag.
+func decodeNumber(tag, value string) (interface{}, error) {
+	switch tag {
+	case "i8":
+		n, err := strconv.ParseInt(value, 10, 8)
+		return int8(n), err
+	case "i16":
+		n, err := strconv.ParseInt(value, 10, 16)
+		return int16(n), err
+	case "i32":
+		n, err := strconv.ParseInt(value, 10, 32)
+		return int32(n), err
+	case "i64":
+		return strconv.ParseInt(value, 10, 64)
+	case "u8":
+		n, err := strconv.ParseUint(value, 10, 8)
+		return uint8(n), err
+	case "u16":
+		n, err := strconv.ParseUint(value, 10, 16)
+		return uint16(n), err
+	case "u32":
+		n, err := strconv.ParseUint(value, 10, 32)
+		return uint32(n), err
+	case "u64":
+		return strconv.ParseUint(value, 10, 64)
+	case "f32":
+		n, err := strconv.ParseFloat(value, 32)
+		return float32(n), err
+	case "f64":
+		return strconv.ParseFloat(value, 64)
 	}
+	return nil, fmt.Errorf("Unknown register type %q", tag)
+}
 
-	// Decode uint16
-	r, _ = regexp.Compile("^uint16\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseUint(matches[1], 10, 16)
-		if err != nil {
-			return str, err
-		}
-		return uint16(result), nil
-	}
+// legacyTags maps the number types of the legacy encoding, e.g. "int64(5)", to the type tags of
+// the current one.
+var legacyTags = map[string]string{
+	"int8":    "i8",
+	"int16":   "i16",
+	"int32":   "i32",
+	"int64":   "i64",
+	"uint8":   "u8",
+	"uint16":  "u16",
+	"uint32":  "u32",
+	"uint64":  "u64",
+	"float32": "f32",
+	"float64": "f64",
+}
 
-	// Decode uint32
-	r, _ = regexp.Compile("^uint32\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseUint(matches[1], 10, 32)
-		if err != nil {
-			return str, err
-		}
-		return uint32(result), nil
+// decodeRegister is the opposite of encodeRegister. Registers in the legacy encoding are still
+// read: it tries to parse out a number type from the given string according to the legacy number
+// encoding format, and if that is not possible, the input is returned as-is. Registers are
+// decoded in a single pass that dispatches on their prefix.
+func decodeRegister(str string) (interface{}, error) {
+	if !isLegacyRegister(str) {
+		return decodeCurrentRegister(str[len(registerPrefix):])
 	}
 
-	// Decode uint64
-	r, _ = regexp.Compile("^uint64\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseUint(matches[1], 10, 64)
-		if err != nil {
-			return str, err
-		}
-		return uint64(result), nil
+	// Legacy numbers have the form type(value). Everything else is a string.
+	open := strings.IndexByte(str, '(')
+	if open < 0 || !strings.HasSuffix(str, ")") {
+		return str, nil
 	}
+	name, value := str[:open], str[open+1:len(str)-1]
 
-	// Decode float32
-	r, _ = regexp.Compile("^float32\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseFloat(matches[1], 32)
-		if err != nil {
-			return str, err
-		}
-		return float32(result), nil
+	// Numbers never span lines, so strings that merely look like numbers are kept as they are.
+	tag, ok := legacyTags[name]
+	if !ok || value == "" || strings.IndexByte(value, '\n') >= 0 {
+		return str, nil
 	}
-
-	// Decode float64
-	r, _ = regexp.Compile("^float64\\((.+)\\)$")
-	matches = r.FindStringSubmatch(str)
-	if len(matches) > 1 {
-		result, err := strconv.ParseFloat(matches[1], 64)
-		if err != nil {
-			return str, err
-		}
-		return float64(result), nil
+	n, err := decodeNumber(tag, value)
+	if err != nil {
+		return str, err
 	}
-
-	return str, nil
+	return n, nil
 }
@@ -0,0 +1,247 @@
+package caribou
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+func TestRegisterBytes(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte{},
+		[]byte{0, 1, 2, 255},
+		[]byte("int64(5)"),
+		[]byte("line one\nline two)"),
+	} {
+		encoded, err := encodeRegister(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeRegister(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, ok := decoded.([]byte); !ok || !bytes.Equal(d, b) {
+			t.Errorf("Expected %q, got %#v", b, decoded)
+		}
+	}
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	for _, v := range []interface{}{
+		"", "hello", "int64(5)", "\x01i64:5", true, false,
+		int8(-8), int16(16), int32(-32), int64(64),
+		uint8(8), uint16(16), uint32(32), uint64(1 << 63),
+		float32(1.5), float64(-2.25),
+	} {
+		encoded, err := encodeRegister(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeRegister(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != v {
+			t.Errorf("Expected %#v, got %#v", v, decoded)
+		}
+	}
+}
+
+func TestDecodeLegacyRegister(t *testing.T) {
+	for encoded, expected := range map[string]interface{}{
+		"plain":        "plain",
+		"int64(5)":     int64(5),
+		"uint8(255)":   uint8(255),
+		"float64(1.5)": float64(1.5),
+		"bool(true)":   "bool(true)",
+	} {
+		decoded, err := decodeRegister(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != expected {
+			t.Errorf("Expected %#v for %q, got %#v", expected, encoded, decoded)
+		}
+	}
+}
+
+type Schedule struct {
+	Start    time.Time
+	Interval time.Duration
+	Host     net.IP
+	Budget   *big.Int
+}
+
+func TestRegisterCodecs(t *testing.T) {
+	s := Schedule{
+		Start:    time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC),
+		Interval: 90 * time.Second,
+		Host:     net.ParseIP("10.0.0.1"),
+		Budget:   big.NewInt(1 << 62),
+	}
+
+	m := make(map[string]interface{})
+	for k, v := range map[string]interface{}{
+		"Start": s.Start, "Interval": s.Interval, "Host": s.Host, "Budget": s.Budget,
+	} {
+		if crdtTypeOf(v) != crdtRegister {
+			t.Errorf("Expected %s to be stored in a register", k)
+		}
+		encoded, err := encodeRegister(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[k], err = decodeRegister(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var decoded Schedule
+	if err := decodeMap(m, &decoded, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Start.Equal(s.Start) || decoded.Interval != s.Interval ||
+		!decoded.Host.Equal(s.Host) || decoded.Budget.Cmp(s.Budget) != 0 {
+		t.Errorf("Expected %+v, got %+v", s, decoded)
+	}
+}
+
+// label can be marshaled as text but not unmarshaled, so it is stored as a nested map.
+type label struct {
+	Text string
+}
+
+func (l label) MarshalText() ([]byte, error) {
+	return []byte(l.Text), nil
+}
+
+// shout can be marshaled as text but not unmarshaled, and can't be stored at all.
+type shout string
+
+func (s shout) MarshalText() ([]byte, error) {
+	return []byte(s + "!"), nil
+}
+
+type Sticker struct {
+	ModelMetadata
+	testContext
+	Label label
+}
+
+func TestMarshalOnlyTypes(t *testing.T) {
+	if hasCodec(reflect.TypeOf(label{})) || hasCodec(reflect.TypeOf(shout(""))) {
+		t.Error("Expected types without UnmarshalText not to have a codec")
+	}
+	if _, err := encodeRegister(shout("hey")); err == nil {
+		t.Error("Expected a register that can't be decoded not to be encoded")
+	}
+
+	store := NewMemoryStore()
+	if err := store.Save(&Sticker{Label: label{"fragile"}}, "s"); err != nil {
+		t.Fatal(err)
+	}
+	var s Sticker
+	if _, err := store.Find(&s, "s"); err != nil || s.Label.Text != "fragile" {
+		t.Errorf("Unexpected sticker %+v, %v", s, err)
+	}
+}
+
+type Appointment struct {
+	ModelMetadata
+	testContext
+	Title string
+	Notes map[string]interface{}
+}
+
+func TestSaveUnknownCustomRegisters(t *testing.T) {
+	start, err := encodeRegister(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var op riak.MapOperation
+	op.SetRegister("Start", []byte(start))
+	op.Map("Notes").SetRegister("Reminder", []byte(start))
+	store := NewMemoryStore()
+	if _, err := store.Apply("a", &op); err != nil {
+		t.Fatal(err)
+	}
+
+	var a Appointment
+	if _, err := store.Find(&a, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Notes["Reminder"].(customRegister); !ok {
+		t.Errorf("Expected the reminder to stay encoded, got %#v", a.Notes["Reminder"])
+	}
+
+	// Start isn't a field of Appointment and Notes doesn't know its value's type, so both are
+	// written back as they were stored.
+	a.Title = "dentist"
+	if err := store.Save(&a, "a"); err != nil {
+		t.Fatal(err)
+	}
+	rm, _, _ := store.Fetch("a")
+	if string(rm.Registers["Start"]) != start ||
+		string(rm.Maps["Notes"].Registers["Reminder"]) != start {
+		t.Errorf("Unexpected map %+v", rm)
+	}
+}
+
+// benchmarkRegisters are typical register values, in the current and the legacy encoding.
+var benchmarkRegisters = []interface{}{
+	"a short string", "", int64(1234567890), int32(-42), uint8(7), float64(3.14159), true,
+	[]byte{0, 1, 2, 3, 4, 5, 6, 7},
+}
+
+var legacyRegisters = []string{
+	"a short string", "int64(1234567890)", "int32(-42)", "uint8(7)", "float64(3.14159E+00)",
+}
+
+func BenchmarkEncodeRegister(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, v := range benchmarkRegisters {
+			if _, err := encodeRegister(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeRegister(b *testing.B) {
+	encoded := make([]string, len(benchmarkRegisters))
+	for i, v := range benchmarkRegisters {
+		var err error
+		if encoded[i], err = encodeRegister(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range encoded {
+			if _, err := decodeRegister(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeLegacyRegister(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, s := range legacyRegisters {
+			if _, err := decodeRegister(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
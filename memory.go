@@ -0,0 +1,276 @@
+package caribou
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+// MemoryStore is a Store that keeps models as CRDT maps in memory, for tests and local
+// development. Map operations are applied the way Riak applies them: removals come first,
+// counters are incremented, set members are added and removed, registers and flags are
+// overwritten and nested maps are updated recursively, creating them if needed. Every update
+// issues a new opaque context.
+type MemoryStore struct {
+	mu       sync.Mutex
+	maps     map[string]*riak.Map
+	contexts map[string][]byte
+	updates  uint64
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		maps:     make(map[string]*riak.Map),
+		contexts: make(map[string][]byte),
+	}
+}
+
+// Find implements Store. Models are migrated when they are loaded, but unlike
+// FindRiakModelByKey the migrated map isn't written back.
+func (s *MemoryStore) Find(model Model, key string) (bool, error) {
+	rm, ctx, ok := s.Fetch(key)
+	if !ok {
+		return false, nil
+	}
+	return true, LoadRiakModel(&riak.FetchMapResponse{Context: ctx, Map: rm}, model)
+}
+
+// Save implements Store the same way StoreModelInRiak does, including what happens when the
+// second of two map operations fails.
+func (s *MemoryStore) Save(model Model, key string) error {
+	return storeModel(model, s.updater(key))
+}
+
+// updater returns a mapUpdater for the map with the given key. Like Apply, it ignores contexts.
+func (s *MemoryStore) updater(key string) mapUpdater {
+	return func(op *riak.MapOperation, _ string, _ bool) (*riak.UpdateMapResponse, error) {
+		if _, err := s.Apply(key, op); err != nil {
+			return nil, err
+		}
+		rm, ctx, _ := s.Fetch(key)
+		return &riak.UpdateMapResponse{Context: ctx, Map: rm}, nil
+	}
+}
+
+// Delete implements Store. Models with a context that isn't the latest one aren't deleted. The
+// model's snapshot and context are cleared, so that saving it again creates a new map.
+func (s *MemoryStore) Delete(model Model, key string) error {
+	s.mu.Lock()
+	stored, ok := s.contexts[key]
+	if ctx := model.GetContext(); ok && ctx != "" && string(stored) != ctx {
+		s.mu.Unlock()
+		return fmt.Errorf("%w for key %q", ErrStaleContext, key)
+	}
+	delete(s.maps, key)
+	delete(s.contexts, key)
+	s.mu.Unlock()
+
+	model.SetSnapshot(nil)
+	model.SetContext("")
+	return nil
+}
+
+// Remove deletes the map with the given key.
+func (s *MemoryStore) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.maps, key)
+	delete(s.contexts, key)
+}
+
+// Fetch returns a copy of the map with the given key and its context. It returns false if there
+// is no such map.
+func (s *MemoryStore) Fetch(key string) (*riak.Map, []byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rm, ok := s.maps[key]
+	if !ok {
+		return nil, nil, false
+	}
+	return copyRiakMap(rm), s.contexts[key], true
+}
+
+// Apply applies the map operation to the map with the given key, creating it if needed, and
+// returns the new context. The operation is applied completely or not at all.
+func (s *MemoryStore) Apply(key string, op *riak.MapOperation) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rm := newRiakMap()
+	if stored, ok := s.maps[key]; ok {
+		rm = copyRiakMap(stored)
+	}
+	if err := applyMapOperation(rm, reflect.ValueOf(op).Elem()); err != nil {
+		return nil, err
+	}
+
+	s.updates++
+	s.maps[key] = rm
+	s.contexts[key] = []byte("mem:" + strconv.FormatUint(s.updates, 36))
+	return s.contexts[key], nil
+}
+
+// applyMapOperation applies op, a riak.MapOperation, to rm. The operation's fields aren't
+// exported, so they are read with reflection.
+func applyMapOperation(rm *riak.Map, op reflect.Value) error {
+	field := func(name string) (reflect.Value, error) {
+		f := op.FieldByName(name)
+		if !f.IsValid() || f.Kind() != reflect.Map {
+			return f, fmt.Errorf("Unsupported riak.MapOperation: no %s field", name)
+		}
+		return f, nil
+	}
+
+	// Removals come first, so that a field can be removed and written again in one operation.
+	for name, removed := range map[string]func(k string){
+		"removeCounters":  func(k string) { delete(rm.Counters, k) },
+		"removeSets":      func(k string) { delete(rm.Sets, k) },
+		"removeRegisters": func(k string) { delete(rm.Registers, k) },
+		"removeFlags":     func(k string) { delete(rm.Flags, k) },
+		"removeMaps":      func(k string) { delete(rm.Maps, k) },
+	} {
+		f, err := field(name)
+		if err != nil {
+			return err
+		}
+		for _, k := range f.MapKeys() {
+			removed(k.String())
+		}
+	}
+
+	f, err := field("incrementCounters")
+	if err != nil {
+		return err
+	}
+	for _, k := range f.MapKeys() {
+		rm.Counters[k.String()] += f.MapIndex(k).Int()
+	}
+
+	// Removing members that aren't in the set does nothing.
+	f, err = field("removeFromSets")
+	if err != nil {
+		return err
+	}
+	for _, k := range f.MapKeys() {
+		if _, ok := rm.Sets[k.String()]; !ok {
+			continue
+		}
+		members := f.MapIndex(k)
+		for i := 0; i < members.Len(); i++ {
+			rm.Sets[k.String()] = removeMember(rm.Sets[k.String()], members.Index(i).Bytes())
+		}
+	}
+	f, err = field("addToSets")
+	if err != nil {
+		return err
+	}
+	for _, k := range f.MapKeys() {
+		members := f.MapIndex(k)
+		for i := 0; i < members.Len(); i++ {
+			rm.Sets[k.String()] = addMember(rm.Sets[k.String()], members.Index(i).Bytes())
+		}
+	}
+
+	f, err = field("registersToSet")
+	if err != nil {
+		return err
+	}
+	for _, k := range f.MapKeys() {
+		rm.Registers[k.String()] = append([]byte{}, f.MapIndex(k).Bytes()...)
+	}
+
+	f, err = field("flagsToSet")
+	if err != nil {
+		return err
+	}
+	for _, k := range f.MapKeys() {
+		rm.Flags[k.String()] = f.MapIndex(k).Bool()
+	}
+
+	// Updating a nested map creates it, even if the update is empty.
+	f, err = field("maps")
+	if err != nil {
+		return err
+	}
+	for _, k := range f.MapKeys() {
+		nested := rm.Maps[k.String()]
+		if nested == nil {
+			nested = newRiakMap()
+			rm.Maps[k.String()] = nested
+		}
+		if err := applyMapOperation(nested, f.MapIndex(k).Elem()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addMember adds member to the sorted set members, unless it is already in it.
+func addMember(members [][]byte, member []byte) [][]byte {
+	i := sort.Search(len(members), func(i int) bool {
+		return bytes.Compare(members[i], member) >= 0
+	})
+	if i < len(members) && bytes.Equal(members[i], member) {
+		return members
+	}
+	members = append(members, nil)
+	copy(members[i+1:], members[i:])
+	members[i] = append([]byte{}, member...)
+	return members
+}
+
+// removeMember removes member from the sorted set members.
+func removeMember(members [][]byte, member []byte) [][]byte {
+	for i := range members {
+		if bytes.Equal(members[i], member) {
+			return append(members[:i], members[i+1:]...)
+		}
+	}
+	return members
+}
+
+// newRiakMap returns an empty riak.Map with all of its maps made.
+func newRiakMap() *riak.Map {
+	return &riak.Map{
+		Counters:  make(map[string]int64),
+		Sets:      make(map[string][][]byte),
+		Registers: make(map[string][]byte),
+		Flags:     make(map[string]bool),
+		Maps:      make(map[string]*riak.Map),
+	}
+}
+
+// copyRiakMap returns a deep copy of rm.
+func copyRiakMap(rm *riak.Map) *riak.Map {
+	c := newRiakMap()
+	for k, v := range rm.Counters {
+		c.Counters[k] = v
+	}
+	for k, members := range rm.Sets {
+		set := make([][]byte, len(members))
+		for i, member := range members {
+			set[i] = append([]byte{}, member...)
+		}
+		c.Sets[k] = set
+	}
+	for k, v := range rm.Registers {
+		c.Registers[k] = append([]byte{}, v...)
+	}
+	for k, v := range rm.Flags {
+		c.Flags[k] = v
+	}
+	for k, v := range rm.Maps {
+		c.Maps[k] = copyRiakMap(v)
+	}
+	return c
+}
@@ -0,0 +1,95 @@
+package caribou
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+type Subscriber struct {
+	ModelMetadata
+	testContext
+	Email   string
+	Lists   []string
+	Opens   Counter
+	Profile struct {
+		Age int64
+	}
+}
+
+func TestMemoryStoreRoundTrip(t *testing.T) {
+	store := NewMemoryStore()
+	s := &Subscriber{Email: "ann@example.com", Lists: []string{"news", "offers"}, Opens: 2}
+	s.Profile.Age = 30
+	if err := store.Save(s, "ann"); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetContext() == "" {
+		t.Error("Expected the saved model to get a context")
+	}
+
+	var found Subscriber
+	ok, err := store.Find(&found, "ann")
+	if err != nil || !ok {
+		t.Fatalf("Expected to find the subscriber, got %v, %v", ok, err)
+	}
+	if found.Email != "ann@example.com" ||
+	!reflect.DeepEqual(found.Lists, []string{"news", "offers"}) || found.Opens != 2 ||
+	found.Profile.Age != 30 || found.GetContext() != s.GetContext() {
+		t.Errorf("Unexpected model %+v", found)
+	}
+
+	// Another server opens an email in the meantime, which the next save mustn't overwrite.
+	var open riak.MapOperation
+	open.IncrementCounter("Opens", 1)
+	if _, err := store.Apply("ann", &open); err != nil {
+		t.Fatal(err)
+	}
+
+	context := found.GetContext()
+	found.Email = "ann@example.org"
+	found.Lists = []string{"news"}
+	found.Opens += 3
+	if err := store.Save(&found, "ann"); err != nil {
+		t.Fatal(err)
+	}
+	if found.GetContext() == context {
+		t.Error("Expected a new context")
+	}
+	if found.Email != "ann@example.org" || len(found.Lists) != 1 || found.Opens != 6 {
+		t.Errorf("Unexpected model after saving %+v", found)
+	}
+
+	// Models loaded before the last update can't delete it.
+	if err := store.Delete(s, "ann"); !errors.Is(err, ErrStaleContext) {
+		t.Errorf("Expected ErrStaleContext, got %v", err)
+	}
+	if err := store.Delete(&found, "ann"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Find(&Subscriber{}, "ann"); ok {
+		t.Error("Expected the subscriber to be deleted")
+	}
+}
+
+// TestMapOperationFields fails when riak.MapOperation no longer has the unexported fields that
+// applyMapOperation reads, e.g. after upgrading the client.
+func TestMapOperationFields(t *testing.T) {
+	op := reflect.TypeOf(riak.MapOperation{})
+	for _, name := range []string{
+		"incrementCounters", "removeCounters", "addToSets", "removeFromSets", "removeSets",
+		"registersToSet", "removeRegisters", "flagsToSet", "removeFlags", "maps", "removeMaps",
+	} {
+		f, ok := op.FieldByName(name)
+		if !ok || f.Type.Kind() != reflect.Map {
+			t.Errorf("riak.MapOperation has no %s map", name)
+		}
+	}
+
+	// Every field is read when an operation is applied.
+	if _, err := NewMemoryStore().Apply("k", &riak.MapOperation{}); err != nil {
+		t.Error(err)
+	}
+}
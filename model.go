@@ -3,6 +3,8 @@ package caribou
 import (
 	"github.com/mitchellh/mapstructure"
 	"encoding/json"
+	"reflect"
+	"strings"
 )
 
 type Model interface {
@@ -15,30 +17,64 @@ type Model interface {
 // LoadMapIntoModel fills in the model data with the contents of the map. The supplied map is
 // stored as the model snapshot.
 func LoadMapIntoModel(m map[string]interface{}, model Model) error {
+	_, err := loadMapIntoModel(m, model, 0)
+	return err
+}
+
+// loadFlags change how loadMapIntoModel loads a map.
+type loadFlags int
+
+const (
+	// keepOriginal returns a copy of the map from before the migrations, if any ran.
+	keepOriginal loadFlags = 1 << iota
+
+	// reload marks maps the model has just saved itself. They were read when the model was
+	// loaded, so they aren't reported to DefaultRecorder again.
+	reload
+)
+
+// loadMapIntoModel implements LoadMapIntoModel. With keepOriginal, a copy of m from before the
+// migrations is returned as well if any migrations ran.
+func loadMapIntoModel(m map[string]interface{}, model Model,
+flags loadFlags) (map[string]interface{}, error) {
 
 	// Load map into struct. This sets the metadata, although the actual fields may be garbled
 	// due to not being migrated yet.
-	err := mapstructure.Decode(m, model)
+	err := decodeMap(m, model, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Migrations modify the map in place, so copy it first if the original is needed.
+	var original map[string]interface{}
+	from := model.GetVersion()
+	if flags&keepOriginal != 0 {
+		original = copyMap(m)
 	}
 
-	// Return the fast forwarded version of m
-	m, err = FastForwardMap(model, m)
+	// Return the fast forwarded version of m. Migration failures come back as a *MigrationError.
+	m, err = fastForward(model, m, len(model.Migrations())-1, flags&reload == 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	version := model.GetVersion()
 
-	// Load fast forwarded map into struct now.
-	err = mapstructure.Decode(m, model)
+	// Load fast forwarded map into struct now. The metadata in m still carries the version it
+	// was stored at, so restore the version reached by FastForwardMap afterwards.
+	err = decodeMap(m, model, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	model.SetVersion(version)
+	clearMissingPointers(m, reflect.ValueOf(model))
 
 	// Set the snapshot to the map that we are loading from.
 	model.SetSnapshot(m)
 
-	return nil
+	if version == from {
+		return nil, nil
+	}
+	return original, nil
 }
 
 // LoadJSONModel is the same as LoadMap except it acceps the input as a JSON byte array instead
@@ -62,3 +98,152 @@ func LoadJSONModel(data []byte, model Model) error {
 	return nil
 }
 
+// unknownFields returns the keys of m that don't map onto any field of the model's struct, for
+// example fields written by a newer version of the service. Keys of nested structs are joined
+// with dots, the same way mapstructure reports them.
+func unknownFields(m map[string]interface{}, model Model) ([]string, error) {
+	t := reflect.TypeOf(model)
+	if t.Kind() != reflect.Ptr {
+		return nil, nil
+	}
+
+	// Decode into a fresh value so that the model itself isn't touched.
+	var md mapstructure.Metadata
+	err := decodeMap(m, reflect.New(t.Elem()).Interface(), &md)
+	if err != nil {
+		return nil, err
+	}
+
+	return md.Unused, nil
+}
+
+// decodeMap decodes m into result with mapstructure, converting the values produced by
+// RiakMapToMap into the types the result's fields need. Fields are matched by the names given in
+// their `caribou` struct tags. Metadata is collected into md if it is
+// not nil.
+func decodeMap(m map[string]interface{}, result interface{}, md *mapstructure.Metadata) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: decodeHook,
+		Metadata:   md,
+		Result:     result,
+		TagName:    "caribou",
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(m)
+}
+
+// bytesType is the type of binary fields.
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// decodeHook converts registers encoded by a codec into the type of the field they are decoded
+// into. It also converts set members, which RiakMapToMap returns as raw strings, into the element
+// type of the field they are decoded into. Members of binary sets are converted to byte slices
+// and members of sets of other types are decoded with decodeRegister. Lists and slices of
+// structs are converted back from their element maps, ordered by key.
+func decodeHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	// Registers encoded by a codec are decoded according to the field type. Without one they are
+	// kept as they are, so that saving writes them back unchanged.
+	if custom, ok := data.(customRegister); ok {
+		if to.Kind() == reflect.Interface {
+			return custom, nil
+		}
+		return decodeCustom(string(custom), to)
+	}
+
+	if from.Kind() == reflect.String && to == bytesType {
+		return []byte(reflect.ValueOf(data).String()), nil
+	}
+
+	if from.Kind() == reflect.Slice && from.Elem().Kind() == reflect.String &&
+	(to.Kind() == reflect.Slice || to.Kind() == reflect.Array) &&
+	to.Elem().Kind() != reflect.String && to.Elem() != bytesType {
+
+		members := reflect.ValueOf(data)
+		decoded := make([]interface{}, members.Len())
+		for i := range decoded {
+			member, err := decodeRegister(members.Index(i).String())
+			if err != nil {
+				return nil, err
+			}
+			decoded[i] = member
+		}
+		return decoded, nil
+	}
+
+	// Lists and slices of structs are stored as maps of element key => element.
+	if m, ok := data.(map[string]interface{}); ok &&
+	(to.Kind() == reflect.Slice || to.Kind() == reflect.Array) {
+		if isStruct(to.Elem()) {
+			return sortedValues(m), nil
+		}
+		return mapToList(m), nil
+	}
+
+	return data, nil
+}
+
+// preserveUnknownFields copies the values at the given paths from the snapshot into the target
+// map, unless the target already has them. This way fields that the model can't represent are
+// carried over unchanged instead of being removed on save.
+func preserveUnknownFields(from map[string]interface{}, to map[string]interface{},
+paths []string) {
+
+	for _, path := range paths {
+		keys := strings.Split(path, ".")
+		src, dst := from, to
+
+		// Walk down to the map holding the last key. Give up if either side doesn't have it.
+		for _, k := range keys[:len(keys)-1] {
+			s, sok := src[k].(map[string]interface{})
+			d, dok := dst[k].(map[string]interface{})
+			if !sok || !dok {
+				src = nil
+				break
+			}
+			src, dst = s, d
+		}
+		if src == nil {
+			continue
+		}
+
+		last := keys[len(keys)-1]
+		if _, ok := dst[last]; !ok {
+			if v, ok := src[last]; ok {
+				dst[last] = v
+			}
+		}
+	}
+}
+
+// copyMap returns a deep copy of m. Nested maps and slices are copied, everything else is
+// assumed to be immutable.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		switch rv := reflect.ValueOf(v); rv.Kind() {
+		case reflect.Map:
+			if nested, ok := v.(map[string]interface{}); ok {
+				c[k] = copyMap(nested)
+				continue
+			}
+			c[k] = v
+		case reflect.Slice:
+			if rv.IsNil() {
+				c[k] = v
+				continue
+			}
+			s := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+			reflect.Copy(s, rv)
+			c[k] = s.Interface()
+		default:
+			c[k] = v
+		}
+	}
+	return c
+}
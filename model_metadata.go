@@ -3,6 +3,7 @@ package caribou
 type ModelMetadata struct {
 	Version string
 	Snapshot map[string]interface{}
+	pending *Operations
 }
 
 //
@@ -34,3 +35,20 @@ func (m *ModelMetadata) GetSnapshot() map[string]interface{} {
 func (m *ModelMetadata) SetSnapshot(v map[string]interface{}) {
 	m.Snapshot = v
 }
+
+//
+// Implement Operator
+//
+
+// Operations returns the pending operations that are sent with the next save.
+func (m *ModelMetadata) Operations() *Operations {
+	if m.pending == nil {
+		m.pending = NewOperations()
+	}
+	return m.pending
+}
+
+// ResetOperations drops all pending operations.
+func (m *ModelMetadata) ResetOperations() {
+	m.pending = nil
+}
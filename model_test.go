@@ -22,6 +22,14 @@ import (
 //	};
 //}
 
+// testContext implements Contexter for test models.
+type testContext struct {
+	context string
+}
+
+func (c *testContext) GetContext() string  { return c.context }
+func (c *testContext) SetContext(s string) { c.context = s }
+
 func TestMigration(t *testing.T) {
 	var a Account
 	err := LoadJSONModel([]byte(`{"ModelMetadata": {"Version": ""}, "State": "Texas"}`), &a)
@@ -31,3 +39,131 @@ func TestMigration(t *testing.T) {
 
 	fmt.Println(a.Country)
 }
+
+type Widget struct {
+	ModelMetadata
+	testContext
+	Name  string
+	Specs struct {
+		Weight int64
+	}
+}
+
+func TestPreserveUnknownFields(t *testing.T) {
+	snapshot := map[string]interface{}{
+		"Name":  "sprocket",
+		"Color": "red",
+		"Specs": map[string]interface{}{"Weight": int64(3), "Height": int64(4)},
+	}
+	unknown, err := unknownFields(snapshot, &Widget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := map[string]interface{}{
+		"Name":  "cog",
+		"Specs": map[string]interface{}{"Weight": int64(5)},
+	}
+	preserveUnknownFields(snapshot, to, unknown)
+
+	if to["Name"] != "cog" || to["Color"] != "red" {
+		t.Errorf("Unexpected top level fields %v", to)
+	}
+	specs := to["Specs"].(map[string]interface{})
+	if specs["Weight"] != int64(5) || specs["Height"] != int64(4) {
+		t.Errorf("Unexpected nested fields %v", specs)
+	}
+}
+
+type Gizmo struct {
+	ModelMetadata
+	testContext
+	Color string
+}
+
+func (g *Gizmo) Migrations() []*Migration {
+	return []*Migration{
+		&Migration{Name: "colour_to_color", Migrate: func(m map[string]interface{}) map[string]interface{} {
+			m["Color"] = m["Colour"]
+			delete(m, "Colour")
+			return m
+		}},
+	}
+}
+
+func TestLoadMapIntoModelKeepsOriginal(t *testing.T) {
+	var g Gizmo
+	original, err := loadMapIntoModel(map[string]interface{}{"Colour": "blue"}, &g, keepOriginal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Color != "blue" || g.GetVersion() != "colour_to_color" {
+		t.Errorf("Unexpected model %+v", g)
+	}
+	if original["Colour"] != "blue" || original["Color"] != nil {
+		t.Errorf("Unexpected original map %v", original)
+	}
+
+	// Nothing is kept once the map is at the latest version.
+	original, err = loadMapIntoModel(map[string]interface{}{
+		"ModelMetadata": map[string]interface{}{"Version": "colour_to_color"},
+		"Color":         "red",
+	}, &g, keepOriginal)
+	if err != nil || original != nil {
+		t.Errorf("Unexpected result %v, %v", original, err)
+	}
+}
+
+type Payload struct {
+	ModelMetadata
+	testContext
+	Body   []byte
+	Hashes [][]byte
+}
+
+func TestLoadMapIntoModelBinary(t *testing.T) {
+	var p Payload
+	err := LoadMapIntoModel(map[string]interface{}{
+		"Body":   []byte{0, 1},
+		"Hashes": []string{"\x00\xff", "ab"},
+	}, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Body) != "\x00\x01" || len(p.Hashes) != 2 || string(p.Hashes[0]) != "\x00\xff" {
+		t.Errorf("Unexpected model %+v", p)
+	}
+}
+
+type Campaign struct {
+	ModelMetadata
+	testContext
+	AdIDs []int64
+	Slots []uint32
+}
+
+func TestLoadMapIntoModelTypedSets(t *testing.T) {
+	ids, err := setMembers([]int64{7, -3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := setMembers([]uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c Campaign
+	err = LoadMapIntoModel(map[string]interface{}{
+		"AdIDs": []string{string(ids[0]), string(ids[1])},
+		"Slots": []string{string(slots[0])},
+	}, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.AdIDs) != 2 || c.AdIDs[0] != 7 || c.AdIDs[1] != -3 {
+		t.Errorf("Unexpected AdIDs %v", c.AdIDs)
+	}
+	if len(c.Slots) != 1 || c.Slots[0] != 1 {
+		t.Errorf("Unexpected Slots %v", c.Slots)
+	}
+}
@@ -0,0 +1,105 @@
+package caribou
+
+import (
+	riak "github.com/basho/riak-go-client"
+)
+
+// Operations are intent-based updates to a model, such as "add one to this counter" or "add this
+// tag", that are sent to Riak as they are instead of being derived from the snapshot. Unlike a
+// diff against a possibly stale snapshot they converge correctly when several servers update the
+// same map at once. Fields that are updated through Operations shouldn't also be modified on the
+// model itself, or the change is applied twice.
+type Operations struct {
+	counters map[string]int64
+	adds     map[string][]interface{}
+	removes  map[string][]interface{}
+	flags    map[string]bool
+	maps     map[string]*Operations
+}
+
+// NewOperations returns an empty set of Operations.
+func NewOperations() *Operations {
+	return &Operations{
+		counters: make(map[string]int64),
+		adds:     make(map[string][]interface{}),
+		removes:  make(map[string][]interface{}),
+		flags:    make(map[string]bool),
+		maps:     make(map[string]*Operations),
+	}
+}
+
+// IncrementCounter adds delta to the counter with the given key.
+func (o *Operations) IncrementCounter(key string, delta int64) *Operations {
+	o.counters[key] += delta
+	return o
+}
+
+// AddToSet adds value to the set with the given key.
+func (o *Operations) AddToSet(key string, value interface{}) *Operations {
+	o.adds[key] = append(o.adds[key], value)
+	return o
+}
+
+// RemoveFromSet removes value from the set with the given key.
+func (o *Operations) RemoveFromSet(key string, value interface{}) *Operations {
+	o.removes[key] = append(o.removes[key], value)
+	return o
+}
+
+// EnableFlag enables the flag with the given key.
+func (o *Operations) EnableFlag(key string) *Operations {
+	o.flags[key] = true
+	return o
+}
+
+// Map returns the Operations for the nested map with the given key.
+func (o *Operations) Map(key string) *Operations {
+	if o.maps[key] == nil {
+		o.maps[key] = NewOperations()
+	}
+	return o.maps[key]
+}
+
+// apply adds the operations to op. It is called after the snapshot diff has been written to op,
+// so these operations take precedence.
+func (o *Operations) apply(op *riak.MapOperation) error {
+	for k, delta := range o.counters {
+		if delta != 0 {
+			op.IncrementCounter(k, delta)
+		}
+	}
+	for k, values := range o.adds {
+		for _, v := range values {
+			member, err := encodeSetMember(v)
+			if err != nil {
+				return err
+			}
+			op.AddToSet(k, member)
+		}
+	}
+	for k, values := range o.removes {
+		for _, v := range values {
+			member, err := encodeSetMember(v)
+			if err != nil {
+				return err
+			}
+			op.RemoveFromSet(k, member)
+		}
+	}
+	for k := range o.flags {
+		op.SetFlag(k, true)
+	}
+	for k, nested := range o.maps {
+		if err := nested.apply(op.Map(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An Operator is a model that records pending Operations. The pending operations are sent with
+// the next save by StoreModelInRiak and reset once it succeeds.
+type Operator interface {
+	Operations() *Operations
+	ResetOperations()
+}
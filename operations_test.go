@@ -0,0 +1,130 @@
+package caribou
+
+import (
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+type Article struct {
+	ModelMetadata
+	testContext
+	Title    string
+	Views    Counter
+	Featured bool
+	Tags     []string
+	IDs      []int64
+	Stats    struct {
+		Shares Counter
+	}
+
+	ops *Operations
+}
+
+func (a *Article) Operations() *Operations {
+	if a.ops == nil {
+		a.ops = NewOperations()
+	}
+	return a.ops
+}
+
+func (a *Article) ResetOperations() {
+	a.ops = nil
+}
+
+func TestOperationsApply(t *testing.T) {
+	store := NewMemoryStore()
+	three, err := encodeSetMember(int64(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seven, err := encodeSetMember(int64(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seed riak.MapOperation
+	seed.AddToSet("IDs", three)
+	if _, err := store.Apply("a", &seed); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := NewOperations().
+		IncrementCounter("Views", 2).
+		IncrementCounter("Unchanged", 0).
+		AddToSet("Tags", "go").
+		AddToSet("IDs", int64(7)).
+		RemoveFromSet("IDs", int64(3)).
+		EnableFlag("Featured")
+	ops.Map("Stats").IncrementCounter("Shares", 1)
+
+	op := &riak.MapOperation{}
+	if err := ops.apply(op); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Apply("a", op); err != nil {
+		t.Fatal(err)
+	}
+
+	rm, _, _ := store.Fetch("a")
+	if rm.Counters["Views"] != 2 || !rm.Flags["Featured"] {
+		t.Errorf("Unexpected counters or flags %+v", rm)
+	}
+	if _, ok := rm.Counters["Unchanged"]; ok {
+		t.Error("Expected zero increments to be skipped")
+	}
+	if tags := rm.Sets["Tags"]; len(tags) != 1 || string(tags[0]) != "go" {
+		t.Errorf("Unexpected Tags %q", tags)
+	}
+	if ids := rm.Sets["IDs"]; len(ids) != 1 || string(ids[0]) != string(seven) {
+		t.Errorf("Unexpected IDs %q", ids)
+	}
+	if stats := rm.Maps["Stats"]; stats == nil || stats.Counters["Shares"] != 1 {
+		t.Errorf("Unexpected Stats %+v", stats)
+	}
+
+	err = NewOperations().AddToSet("Tags", struct{}{}).apply(&riak.MapOperation{})
+	if err == nil {
+		t.Error("Expected an error for a member that can't be encoded")
+	}
+}
+
+func TestOperationsSave(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.Save(&Article{Title: "draft", Tags: []string{"go"}}, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var a Article
+	if _, err := store.Find(&a, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another server counts a view after the article was loaded.
+	var view riak.MapOperation
+	view.IncrementCounter("Views", 1)
+	if _, err := store.Apply("a", &view); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending operations are merged with the diff against the snapshot.
+	a.Title = "final"
+	a.Operations().IncrementCounter("Views", 1).AddToSet("Tags", "riak")
+	if err := store.Save(&a, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if a.Title != "final" || a.Views != 2 || len(a.Tags) != 2 {
+		t.Errorf("Unexpected article %+v", a)
+	}
+
+	// Saved operations are reset, so saving again doesn't repeat them.
+	if a.ops != nil {
+		t.Errorf("Expected the operations to be reset, got %+v", a.ops)
+	}
+	if err := store.Save(&a, "a"); err != nil {
+		t.Fatal(err)
+	}
+	rm, _, _ := store.Fetch("a")
+	if rm.Counters["Views"] != 2 || len(rm.Sets["Tags"]) != 2 {
+		t.Errorf("Unexpected map after saving again %+v", rm)
+	}
+}
@@ -0,0 +1,662 @@
+// Package riaktest provides a stand-in for a Riak node that the real riak.Client can talk to, so
+// that code building Riak commands can be tested without a cluster. The server speaks the subset
+// of the protocol buffers API that caribou uses: Ping, Get, Put, Delete, ListKeys, queries of the
+// `$bucket` index, DtFetch and DtUpdate on maps. Maps are kept in a caribou.MemoryStore and other
+// values in memory as well.
+package riaktest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	riak "github.com/basho/riak-go-client"
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+	rpbRiakDT "github.com/basho/riak-go-client/rpb/riak_dt"
+	rpbRiakKV "github.com/basho/riak-go-client/rpb/riak_kv"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/lopatin/caribou"
+)
+
+// Message codes of the protocol buffers API.
+const (
+	codeErrorResp    byte = 0
+	codePingReq      byte = 1
+	codePingResp     byte = 2
+	codeGetReq       byte = 9
+	codeGetResp      byte = 10
+	codePutReq       byte = 11
+	codePutResp      byte = 12
+	codeDelReq       byte = 13
+	codeDelResp      byte = 14
+	codeListKeysReq  byte = 17
+	codeListKeysResp byte = 18
+	codeIndexReq     byte = 25
+	codeIndexResp    byte = 26
+	codeDtFetchReq   byte = 80
+	codeDtFetchResp  byte = 81
+	codeDtUpdateReq  byte = 82
+	codeDtUpdateResp byte = 83
+)
+
+// maxMessageSize limits the size of the messages the server reads.
+const maxMessageSize = 64 << 20
+
+// Server is a fake Riak node listening on localhost. Like Riak, it refuses map operations
+// outside of a bucket type, contexts it didn't issue and removals of fields or set members that
+// aren't there when no context is given.
+type Server struct {
+	listener net.Listener
+	maps     *caribou.MemoryStore
+
+	mu       sync.Mutex
+	objects  map[string]*object
+	keys     map[string]map[string]bool
+	contexts map[string]bool
+	conns    map[net.Conn]bool
+	nextKey  int
+	closed   bool
+	wg       sync.WaitGroup
+
+	clientOnce sync.Once
+	client     *riak.Client
+	clientErr  error
+}
+
+var _ caribou.RiakExecutor = (*Server)(nil)
+
+// object is a value stored with Put.
+type object struct {
+	content *rpbRiakKV.RpbContent
+	vclock  []byte
+}
+
+// NewServer starts a Server on a free port on localhost.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		maps:     caribou.NewMemoryStore(),
+		objects:  make(map[string]*object),
+		keys:     make(map[string]map[string]bool),
+		contexts: make(map[string]bool),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the host:port address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// NewClient returns a riak.Client connected to the server.
+func (s *Server) NewClient() (*riak.Client, error) {
+	return riak.NewClient(&riak.NewClientOptions{RemoteAddresses: []string{s.Addr()}})
+}
+
+// Exec runs f with a client connected to the server, so that the Server can be passed to
+// caribou's Riak functions in place of a *caribou.RiakService. The client is created on first use
+// and stopped by Close.
+func (s *Server) Exec(f func(client *riak.Client) error) error {
+	s.clientOnce.Do(func() {
+		s.client, s.clientErr = s.NewClient()
+	})
+	if s.clientErr != nil {
+		return s.clientErr
+	}
+	return f(s.client)
+}
+
+// Map returns a copy of the map stored under the given bucket type, bucket and key.
+func (s *Server) Map(bucketType, bucket, key string) (*riak.Map, bool) {
+	rm, _, ok := s.maps.Fetch(storeKey(bucketType, bucket, key))
+	return rm, ok
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	// Keep Exec from creating a client from now on.
+	s.clientOnce.Do(func() {})
+	if s.client != nil {
+		s.client.Stop()
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// accept serves connections until the listener is closed.
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests sent on conn until it is closed. Requests that fail are answered
+// with an error response, like Riak does.
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		code, body, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if err := s.handle(conn, code, body); err != nil {
+			resp := &rpbRiak.RpbErrorResp{Errmsg: []byte(err.Error()), Errcode: proto.Uint32(0)}
+			if writeMessage(conn, codeErrorResp, resp) != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle answers a single request.
+func (s *Server) handle(w io.Writer, code byte, body []byte) error {
+	switch code {
+	case codePingReq:
+		return writeMessage(w, codePingResp, nil)
+
+	case codeGetReq:
+		req := &rpbRiakKV.RpbGetReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		return writeMessage(w, codeGetResp, s.get(req))
+
+	case codePutReq:
+		req := &rpbRiakKV.RpbPutReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		return writeMessage(w, codePutResp, s.put(req))
+
+	case codeDelReq:
+		req := &rpbRiakKV.RpbDelReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		s.delete(bucketType(req.GetType()), string(req.GetBucket()), string(req.GetKey()))
+		return writeMessage(w, codeDelResp, nil)
+
+	case codeListKeysReq:
+		req := &rpbRiakKV.RpbListKeysReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		return s.listKeys(w, req)
+
+	case codeIndexReq:
+		req := &rpbRiakKV.RpbIndexReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		return s.index(w, req)
+
+	case codeDtFetchReq:
+		req := &rpbRiakDT.DtFetchReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		resp, err := s.fetchMap(req)
+		if err != nil {
+			return err
+		}
+		return writeMessage(w, codeDtFetchResp, resp)
+
+	case codeDtUpdateReq:
+		req := &rpbRiakDT.DtUpdateReq{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return err
+		}
+		resp, err := s.updateMap(req)
+		if err != nil {
+			return err
+		}
+		return writeMessage(w, codeDtUpdateResp, resp)
+	}
+
+	return fmt.Errorf("Unsupported message code %d", code)
+}
+
+// get answers a Get request. Missing objects have no content.
+func (s *Server) get(req *rpbRiakKV.RpbGetReq) *rpbRiakKV.RpbGetResp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.objects[storeKey(bucketType(req.GetType()), string(req.GetBucket()),
+		string(req.GetKey()))]
+	if o == nil {
+		return &rpbRiakKV.RpbGetResp{}
+	}
+	return &rpbRiakKV.RpbGetResp{Content: []*rpbRiakKV.RpbContent{o.content}, Vclock: o.vclock}
+}
+
+// put answers a Put request. Requests without a key are stored under a generated key.
+func (s *Server) put(req *rpbRiakKV.RpbPutReq) *rpbRiakKV.RpbPutResp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &rpbRiakKV.RpbPutResp{}
+	bt, bucket, key := bucketType(req.GetType()), string(req.GetBucket()), string(req.GetKey())
+	if key == "" {
+		key = s.generateKey()
+		resp.Key = []byte(key)
+	}
+
+	s.nextKey++
+	o := &object{content: req.GetContent(), vclock: []byte("vclock:" + strconv.Itoa(s.nextKey))}
+	s.objects[storeKey(bt, bucket, key)] = o
+	s.addKey(bt, bucket, key)
+
+	if req.GetReturnBody() {
+		resp.Content = []*rpbRiakKV.RpbContent{o.content}
+		resp.Vclock = o.vclock
+	}
+	return resp
+}
+
+// delete removes the object and the map with the given key.
+func (s *Server) delete(bt, bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, storeKey(bt, bucket, key))
+	s.maps.Remove(storeKey(bt, bucket, key))
+	delete(s.keys[bt+"/"+bucket], key)
+}
+
+// listKeys streams the keys of a bucket in a single response, followed by the done marker.
+func (s *Server) listKeys(w io.Writer, req *rpbRiakKV.RpbListKeysReq) error {
+	var keys [][]byte
+	for _, key := range s.bucketKeys(bucketType(req.GetType()), string(req.GetBucket())) {
+		keys = append(keys, []byte(key))
+	}
+
+	if len(keys) > 0 {
+		err := writeMessage(w, codeListKeysResp, &rpbRiakKV.RpbListKeysResp{Keys: keys})
+		if err != nil {
+			return err
+		}
+	}
+	return writeMessage(w, codeListKeysResp, &rpbRiakKV.RpbListKeysResp{Done: proto.Bool(true)})
+}
+
+// index answers a query of the `$bucket` index, which matches every key of the bucket. Keys are
+// returned in order, and the continuation of a page is the last key in it.
+func (s *Server) index(w io.Writer, req *rpbRiakKV.RpbIndexReq) error {
+	if string(req.GetIndex()) != "$bucket" || req.GetReturnTerms() {
+		return fmt.Errorf("Unsupported index query on %q", req.GetIndex())
+	}
+
+	keys := s.bucketKeys(bucketType(req.GetType()), string(req.GetBucket()))
+	if after := string(req.GetContinuation()); after != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > after }):]
+	}
+
+	resp := &rpbRiakKV.RpbIndexResp{}
+	if max := int(req.GetMaxResults()); max > 0 && len(keys) > max {
+		keys = keys[:max]
+		resp.Continuation = []byte(keys[max-1])
+	}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, []byte(key))
+	}
+	if req.GetStream() {
+		resp.Done = proto.Bool(true)
+	}
+	return writeMessage(w, codeIndexResp, resp)
+}
+
+// fetchMap answers a DtFetch request. Missing maps have no value.
+func (s *Server) fetchMap(req *rpbRiakDT.DtFetchReq) (*rpbRiakDT.DtFetchResp, error) {
+	if err := checkBucketType(req.GetType()); err != nil {
+		return nil, err
+	}
+
+	resp := &rpbRiakDT.DtFetchResp{Type: rpbRiakDT.DtFetchResp_MAP.Enum()}
+	key := storeKey(string(req.GetType()), string(req.GetBucket()), string(req.GetKey()))
+	rm, ctx, ok := s.maps.Fetch(key)
+	if !ok {
+		return resp, nil
+	}
+
+	resp.Value = &rpbRiakDT.DtValue{MapValue: mapEntries(rm)}
+	if req.IncludeContext == nil || req.GetIncludeContext() {
+		resp.Context = ctx
+	}
+	return resp, nil
+}
+
+// updateMap answers a DtUpdate request. Requests without a key are stored under a generated key.
+func (s *Server) updateMap(req *rpbRiakDT.DtUpdateReq) (*rpbRiakDT.DtUpdateResp, error) {
+	if err := checkBucketType(req.GetType()); err != nil {
+		return nil, err
+	}
+	mapOp := req.GetOp().GetMapOp()
+	if mapOp == nil {
+		return nil, errors.New("Only map operations are supported")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &rpbRiakDT.DtUpdateResp{}
+	bt, bucket, key := string(req.GetType()), string(req.GetBucket()), string(req.GetKey())
+	if key == "" {
+		key = s.generateKey()
+		resp.Key = []byte(key)
+	}
+
+	// Contexts have to be ones the server issued. Without a context, removals only apply to
+	// what is there.
+	if len(req.GetContext()) > 0 {
+		if !s.contexts[string(req.GetContext())] {
+			return nil, fmt.Errorf("Invalid context %q", req.GetContext())
+		}
+	} else {
+		rm, _, ok := s.maps.Fetch(storeKey(bt, bucket, key))
+		if !ok {
+			rm = &riak.Map{}
+		}
+		if err := checkRemovals(rm, mapOp); err != nil {
+			return nil, err
+		}
+	}
+
+	op := &riak.MapOperation{}
+	mapOperation(mapOp, op)
+	ctx, err := s.maps.Apply(storeKey(bt, bucket, key), op)
+	if err != nil {
+		return nil, err
+	}
+	s.contexts[string(ctx)] = true
+	s.addKey(bt, bucket, key)
+
+	if req.GetReturnBody() {
+		rm, _, _ := s.maps.Fetch(storeKey(bt, bucket, key))
+		resp.MapValue = mapEntries(rm)
+	}
+	if req.GetReturnBody() || req.GetIncludeContext() {
+		resp.Context = ctx
+	}
+	return resp, nil
+}
+
+// generateKey returns a new key for values stored without one. The caller holds s.mu.
+func (s *Server) generateKey() string {
+	s.nextKey++
+	return "generated-" + strconv.Itoa(s.nextKey)
+}
+
+// addKey records the key for ListKeys. The caller holds s.mu.
+func (s *Server) addKey(bt, bucket, key string) {
+	if s.keys[bt+"/"+bucket] == nil {
+		s.keys[bt+"/"+bucket] = make(map[string]bool)
+	}
+	s.keys[bt+"/"+bucket][key] = true
+}
+
+// bucketKeys returns the keys of a bucket in order.
+func (s *Server) bucketKeys(bt, bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.keys[bt+"/"+bucket]))
+	for key := range s.keys[bt+"/"+bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// storeKey joins a bucket type, bucket and key into a single key for the stores.
+func storeKey(bt, bucket, key string) string {
+	return bt + "\x00" + bucket + "\x00" + key
+}
+
+// bucketType returns the bucket type of a KV request, which defaults to "default".
+func bucketType(t []byte) string {
+	if len(t) == 0 {
+		return "default"
+	}
+	return string(t)
+}
+
+// checkBucketType refuses data type requests outside of a bucket type, like Riak does for
+// buckets without a datatype property.
+func checkBucketType(t []byte) error {
+	if len(t) == 0 || string(t) == "default" {
+		return errors.New("Bucket type is required for data types")
+	}
+	return nil
+}
+
+// checkRemovals returns an error for removals of fields and set members that aren't in rm.
+func checkRemovals(rm *riak.Map, op *rpbRiakDT.MapOp) error {
+	for _, f := range op.GetRemoves() {
+		if !hasField(rm, f) {
+			return fmt.Errorf("{precondition,{not_present,{<<\"%s\">>,%s}}}", f.GetName(),
+				f.GetType())
+		}
+	}
+
+	for _, u := range op.GetUpdates() {
+		name := string(u.GetField().GetName())
+		switch u.GetField().GetType() {
+		case rpbRiakDT.MapField_SET:
+			for _, member := range u.GetSetOp().GetRemoves() {
+				if !hasMember(rm.Sets[name], member) {
+					return fmt.Errorf("{precondition,{not_present,<<\"%s\">>}}", member)
+				}
+			}
+		case rpbRiakDT.MapField_MAP:
+			nested := rm.Maps[name]
+			if nested == nil {
+				nested = &riak.Map{}
+			}
+			if err := checkRemovals(nested, u.GetMapOp()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasField reports whether rm has the field f.
+func hasField(rm *riak.Map, f *rpbRiakDT.MapField) bool {
+	name := string(f.GetName())
+	var ok bool
+	switch f.GetType() {
+	case rpbRiakDT.MapField_COUNTER:
+		_, ok = rm.Counters[name]
+	case rpbRiakDT.MapField_SET:
+		_, ok = rm.Sets[name]
+	case rpbRiakDT.MapField_REGISTER:
+		_, ok = rm.Registers[name]
+	case rpbRiakDT.MapField_FLAG:
+		_, ok = rm.Flags[name]
+	case rpbRiakDT.MapField_MAP:
+		_, ok = rm.Maps[name]
+	}
+	return ok
+}
+
+// hasMember reports whether the set members contains member.
+func hasMember(members [][]byte, member []byte) bool {
+	for _, m := range members {
+		if string(m) == string(member) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapOperation adds the operations of the protocol buffers map operation pb to op.
+func mapOperation(pb *rpbRiakDT.MapOp, op *riak.MapOperation) {
+	for _, f := range pb.GetRemoves() {
+		name := string(f.GetName())
+		switch f.GetType() {
+		case rpbRiakDT.MapField_COUNTER:
+			op.RemoveCounter(name)
+		case rpbRiakDT.MapField_SET:
+			op.RemoveSet(name)
+		case rpbRiakDT.MapField_REGISTER:
+			op.RemoveRegister(name)
+		case rpbRiakDT.MapField_FLAG:
+			op.RemoveFlag(name)
+		case rpbRiakDT.MapField_MAP:
+			op.RemoveMap(name)
+		}
+	}
+
+	for _, u := range pb.GetUpdates() {
+		name := string(u.GetField().GetName())
+		switch u.GetField().GetType() {
+		case rpbRiakDT.MapField_COUNTER:
+			op.IncrementCounter(name, u.GetCounterOp().GetIncrement())
+		case rpbRiakDT.MapField_SET:
+			for _, member := range u.GetSetOp().GetRemoves() {
+				op.RemoveFromSet(name, member)
+			}
+			for _, member := range u.GetSetOp().GetAdds() {
+				op.AddToSet(name, member)
+			}
+		case rpbRiakDT.MapField_REGISTER:
+			op.SetRegister(name, u.GetRegisterOp())
+		case rpbRiakDT.MapField_FLAG:
+			op.SetFlag(name, u.GetFlagOp() == rpbRiakDT.MapUpdate_ENABLE)
+		case rpbRiakDT.MapField_MAP:
+			mapOperation(u.GetMapOp(), op.Map(name))
+		}
+	}
+}
+
+// mapEntries converts rm into protocol buffers map entries, ordered by field name.
+func mapEntries(rm *riak.Map) []*rpbRiakDT.MapEntry {
+	var entries []*rpbRiakDT.MapEntry
+	field := func(name string, t rpbRiakDT.MapField_MapFieldType) *rpbRiakDT.MapField {
+		return &rpbRiakDT.MapField{Name: []byte(name), Type: t.Enum()}
+	}
+
+	for name, v := range rm.Counters {
+		entries = append(entries, &rpbRiakDT.MapEntry{
+			Field:        field(name, rpbRiakDT.MapField_COUNTER),
+			CounterValue: proto.Int64(v),
+		})
+	}
+	for name, members := range rm.Sets {
+		entries = append(entries, &rpbRiakDT.MapEntry{
+			Field:    field(name, rpbRiakDT.MapField_SET),
+			SetValue: members,
+		})
+	}
+	for name, v := range rm.Registers {
+		entries = append(entries, &rpbRiakDT.MapEntry{
+			Field:         field(name, rpbRiakDT.MapField_REGISTER),
+			RegisterValue: v,
+		})
+	}
+	for name, v := range rm.Flags {
+		entries = append(entries, &rpbRiakDT.MapEntry{
+			Field:     field(name, rpbRiakDT.MapField_FLAG),
+			FlagValue: proto.Bool(v),
+		})
+	}
+	for name, nested := range rm.Maps {
+		entries = append(entries, &rpbRiakDT.MapEntry{
+			Field:    field(name, rpbRiakDT.MapField_MAP),
+			MapValue: mapEntries(nested),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].GetField(), entries[j].GetField()
+		if string(a.GetName()) != string(b.GetName()) {
+			return string(a.GetName()) < string(b.GetName())
+		}
+		return a.GetType() < b.GetType()
+	})
+	return entries
+}
+
+// readMessage reads a message: its length as a 4 byte big endian number, the message code and
+// the protocol buffers encoded body.
+func readMessage(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxMessageSize {
+		return 0, nil, fmt.Errorf("Invalid message size %d", size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+	return msg[0], msg[1:], nil
+}
+
+// writeMessage writes a message in the format read by readMessage. Messages without a body, like
+// the ping response, are written with a nil msg.
+func writeMessage(w io.Writer, code byte, msg proto.Message) error {
+	var body []byte
+	if msg != nil {
+		var err error
+		if body, err = proto.Marshal(msg); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(body)))
+	buf[4] = code
+	copy(buf[5:], body)
+	_, err := w.Write(buf)
+	return err
+}
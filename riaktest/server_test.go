@@ -0,0 +1,312 @@
+package riaktest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+
+	"github.com/lopatin/caribou"
+)
+
+func TestServerMaps(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	client, err := s.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	ping, err := riak.NewPingCommandBuilder().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Execute(ping); err != nil {
+		t.Fatal(err)
+	}
+
+	op := &riak.MapOperation{}
+	op.SetRegister("Name", []byte("ann")).IncrementCounter("Opens", 2)
+	op.AddToSet("Lists", []byte("news"))
+	op.Map("Profile").SetFlag("Verified", true)
+	update, err := riak.NewUpdateMapCommandBuilder().
+	WithBucketType("maps").
+	WithBucket("users").
+	WithKey("ann").
+	WithReturnBody(true).
+	WithMapOperation(op).
+	Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Execute(update); err != nil {
+		t.Fatal(err)
+	}
+	resp := update.(*riak.UpdateMapCommand).Response
+	if string(resp.Map.Registers["Name"]) != "ann" || resp.Map.Counters["Opens"] != 2 ||
+	!resp.Map.Maps["Profile"].Flags["Verified"] || len(resp.Context) == 0 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	fetch, err := riak.NewFetchMapCommandBuilder().
+	WithBucketType("maps").
+	WithBucket("users").
+	WithKey("bob").
+	Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	if !fetch.(*riak.FetchMapCommand).Response.IsNotFound {
+		t.Error("Expected bob not to be found")
+	}
+
+	// Removing a field that isn't there fails without a context, like it does in Riak. The client
+	// refuses removals without a context, so the context is one the server never issued.
+	remove := &riak.MapOperation{}
+	remove.RemoveRegister("Email")
+	update, err = riak.NewUpdateMapCommandBuilder().
+	WithBucketType("maps").
+	WithBucket("users").
+	WithKey("ann").
+	WithContext([]byte("stale")).
+	WithMapOperation(remove).
+	Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Execute(update); err == nil {
+		t.Error("Expected an unknown context to fail")
+	}
+}
+
+// execute runs cmd with the client of the server.
+func execute(t *testing.T, s *Server, cmd riak.Command) {
+	t.Helper()
+	if err := s.Exec(func(client *riak.Client) error { return client.Execute(cmd) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerValues(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	store := func(key string) *riak.StoreValueResponse {
+		cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucket("notes").
+		WithKey(key).
+		WithReturnBody(true).
+		WithContent(&riak.Object{ContentType: "text/plain", Value: []byte("hello")}).
+		Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		execute(t, s, cmd)
+		return cmd.(*riak.StoreValueCommand).Response
+	}
+	fetch := func(key string) *riak.FetchValueResponse {
+		cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket("notes").
+		WithKey(key).
+		Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		execute(t, s, cmd)
+		return cmd.(*riak.FetchValueCommand).Response
+	}
+
+	resp := store("a")
+	if len(resp.Values) != 1 || string(resp.Values[0].Value) != "hello" {
+		t.Errorf("Unexpected store response %+v", resp)
+	}
+	generated := store("").GeneratedKey
+	if generated == "" {
+		t.Error("Expected a generated key")
+	}
+
+	got := fetch("a")
+	if got.IsNotFound || len(got.Values) != 1 || string(got.Values[0].Value) != "hello" {
+		t.Errorf("Unexpected fetch response %+v", got)
+	}
+
+	list, err := riak.NewListKeysCommandBuilder().
+	WithBucket("notes").
+	WithAllowListing().
+	Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute(t, s, list)
+	keys := list.(*riak.ListKeysCommand).Response.Keys
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != generated {
+		t.Errorf("Unexpected keys %q", keys)
+	}
+
+	del, err := riak.NewDeleteValueCommandBuilder().
+	WithBucket("notes").
+	WithKey("a").
+	Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute(t, s, del)
+	if !fetch("a").IsNotFound {
+		t.Error("Expected a to be deleted")
+	}
+}
+
+// customer is a model whose Address used to be a single register.
+type customer struct {
+	caribou.ModelMetadata
+	Name    string
+	Address struct {
+		Street string
+	}
+
+	context string
+}
+
+func (c *customer) GetContext() string  { return c.context }
+func (c *customer) SetContext(s string) { c.context = s }
+
+func (c *customer) Migrations() []*caribou.Migration {
+	return []*caribou.Migration{
+		&caribou.Migration{
+			Name: "address_to_map",
+			Migrate: func(m map[string]interface{}) map[string]interface{} {
+				if street, ok := m["Address"].(string); ok {
+					m["Address"] = map[string]interface{}{"Street": street}
+				}
+				return m
+			},
+		},
+	}
+}
+
+func TestServerModels(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := &customer{Name: "ann"}
+	c.Address.Street = "Main Street"
+	if err := caribou.StoreModelInRiak(c, "customers", "ann", s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Map(caribou.BucketTypeMaps, "customers", "ann"); !ok || c.GetContext() == "" {
+		t.Fatalf("Expected ann to be stored with a context, got %q", c.GetContext())
+	}
+
+	var found customer
+	ok, err := caribou.FindRiakModelByKey(&found, "customers", "ann", s)
+	if err != nil || !ok {
+		t.Fatalf("Expected to find ann, got %v, %v", ok, err)
+	}
+	if found.Name != "ann" || found.Address.Street != "Main Street" {
+		t.Errorf("Unexpected model %+v", found)
+	}
+
+	ok, err = caribou.FindRiakModelByKey(&customer{}, "customers", "bob", s)
+	if err != nil || ok {
+		t.Errorf("Expected bob not to be found, got %v, %v", ok, err)
+	}
+
+	// The model stored first has the context from before the update made by found.
+	found.Name = "anne"
+	if err := caribou.StoreModelInRiak(&found, "customers", "ann", s); err != nil {
+		t.Fatal(err)
+	}
+	err = caribou.DeleteRiakModel(c, "customers", "ann", s)
+	if !errors.Is(err, caribou.ErrStaleContext) {
+		t.Errorf("Expected ErrStaleContext, got %v", err)
+	}
+	if err := caribou.DeleteRiakModel(&found, "customers", "ann", s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Map(caribou.BucketTypeMaps, "customers", "ann"); ok {
+		t.Error("Expected ann to be deleted")
+	}
+}
+
+// storeOldCustomer stores a customer from before the address_to_map migration.
+func storeOldCustomer(t *testing.T, s *Server, bucket, key string) {
+	op := &riak.MapOperation{}
+	op.SetRegister("Name", []byte(key)).SetRegister("Address", []byte("1 Main Street"))
+	cmd, err := riak.NewUpdateMapCommandBuilder().
+	WithBucketType(caribou.BucketTypeMaps).
+	WithBucket(bucket).
+	WithKey(key).
+	WithMapOperation(op).
+	Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute(t, s, cmd)
+}
+
+// TestServerBackfill migrates maps in which Address changed from a register to a map. Each of
+// them is written back in two steps, the second with the context returned by the first.
+func TestServerBackfill(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, listKeys := range []bool{false, true} {
+		bucket := fmt.Sprintf("customers-%v", listKeys)
+		for _, key := range []string{"ann", "bob", "cat"} {
+			storeOldCustomer(t, s, bucket, key)
+		}
+
+		var checkpoints []string
+		b := &caribou.Backfill{
+			BucketName: bucket,
+			Service:    s,
+			NewModel:   func() caribou.Model { return &customer{} },
+			PageSize:   2,
+			ListKeys:   listKeys,
+			OnCheckpoint: func(checkpoint string, report caribou.BackfillReport) {
+				checkpoints = append(checkpoints, checkpoint)
+			},
+			OnError: func(key string, err error) { t.Errorf("Failed to migrate %s: %v", key, err) },
+		}
+		report, err := b.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Keys != 3 || report.Migrated != 3 || report.Versions[""] != 3 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		if !listKeys && (len(checkpoints) != 2 || checkpoints[0] != "bob") {
+			t.Errorf("Unexpected checkpoints %q", checkpoints)
+		}
+
+		for _, key := range []string{"ann", "bob", "cat"} {
+			rm, _ := s.Map(caribou.BucketTypeMaps, bucket, key)
+			_, register := rm.Registers["Address"]
+			if register || rm.Maps["Address"] == nil ||
+			!strings.HasSuffix(string(rm.Maps["Address"].Registers["Street"]), "1 Main Street") {
+				t.Errorf("Expected %s/%s to be migrated, got %+v", bucket, key, rm)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package caribou
+
+import "errors"
+
+// A Store persists models by key. Stores load maps with LoadMapIntoModel, so models are migrated
+// lazily and keep a snapshot that the next save is diffed against. The model's Contexter value
+// is an opaque causality token: Find and Save set it, Save hands it back to the backend as it is
+// and Delete checks it against the stored model.
+type Store interface {
+	// Find loads the model with the given key. It returns false if there is no such model.
+	Find(model Model, key string) (bool, error)
+
+	// Save stores the model under the given key and loads the stored state back into it.
+	Save(model Model, key string) error
+
+	// Delete removes the model with the given key. Deleting a missing model isn't an error. If
+	// the model has a context and the stored model was updated since it was issued, nothing is
+	// deleted and an error wrapping ErrStaleContext is returned.
+	Delete(model Model, key string) error
+}
+
+// ErrStaleContext is returned by Store.Delete for models that were updated in the store since
+// they were loaded.
+var ErrStaleContext = errors.New("Stale context")
+
+// RiakStore is a Store that keeps models as CRDT maps in a Riak bucket of the BucketTypeMaps
+// bucket type.
+type RiakStore struct {
+	BucketName string
+	Service    RiakExecutor
+}
+
+var _ Store = (*RiakStore)(nil)
+
+// NewRiakStore returns a RiakStore for the given bucket.
+func NewRiakStore(bucketName string, rs RiakExecutor) *RiakStore {
+	return &RiakStore{BucketName: bucketName, Service: rs}
+}
+
+// Find implements Store using FindRiakModelByKey.
+func (s *RiakStore) Find(model Model, key string) (bool, error) {
+	return FindRiakModelByKey(model, s.BucketName, key, s.Service)
+}
+
+// Save implements Store using StoreModelInRiak.
+func (s *RiakStore) Save(model Model, key string) error {
+	return StoreModelInRiak(model, s.BucketName, key, s.Service)
+}
+
+// Delete implements Store using DeleteRiakModel.
+func (s *RiakStore) Delete(model Model, key string) error {
+	return DeleteRiakModel(model, s.BucketName, key, s.Service)
+}
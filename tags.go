@@ -0,0 +1,410 @@
+package caribou
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fieldTag is the parsed `caribou:"name,kind,omitempty"` struct tag of a model field. The name
+// is the name of the field in Riak and defaults to the Go field name. The kind is one of
+// register, flag, set, counter and map, and overrides the kind of CRDT that would otherwise be
+// inferred from the field's Go type. The list option stores a slice as an ordered list, key marks
+// the field that identifies a struct inside a slice, and omitempty removes the field from Riak
+// when it has its zero value.
+type fieldTag struct {
+	name      string
+	kind      crdtType
+	list      bool
+	key       bool
+	omitempty bool
+}
+
+// tagKinds maps the kind names allowed in struct tags to CRDT kinds.
+var tagKinds = map[string]crdtType{
+	"register": crdtRegister,
+	"flag":     crdtFlag,
+	"set":      crdtSet,
+	"counter":  crdtCounter,
+	"map":      crdtMap,
+}
+
+// tagOf parses the `caribou` struct tag of f.
+func tagOf(f reflect.StructField) (fieldTag, error) {
+	parts := strings.Split(f.Tag.Get("caribou"), ",")
+	tag := fieldTag{name: parts[0]}
+	if tag.name == "" {
+		tag.name = f.Name
+	}
+
+	for _, option := range parts[1:] {
+		switch option {
+		case "list":
+			tag.list = true
+		case "key":
+			tag.key = true
+		case "omitempty":
+			tag.omitempty = true
+		case "":
+		default:
+			kind, ok := tagKinds[option]
+			if !ok {
+				return tag, fmt.Errorf("Field %q has unknown caribou tag option %q", f.Name,
+					option)
+			}
+			tag.kind = kind
+		}
+	}
+	return tag, nil
+}
+
+// kindValue is a value that is stored as the kind of CRDT chosen by a struct tag rather than
+// the kind inferred from its Go type.
+type kindValue struct {
+	kind  crdtType
+	value interface{}
+}
+
+// unwrapKind returns the value inside a kindValue, or v itself.
+func unwrapKind(v interface{}) interface{} {
+	if kv, ok := v.(kindValue); ok {
+		return kv.value
+	}
+	return v
+}
+
+// encodeFields rewrites m, which was built from the struct value v and is keyed by Go field
+// name, into the layout that is stored in Riak. Fields are renamed and given the kind set by
+// their struct tags, and zero values of omitempty fields are dropped. Slice fields tagged with
+// `caribou:",list"` become nested maps keyed by element index, so that Riak keeps their order and
+// duplicates. Slices and maps of structs become nested maps of element maps, keyed by the
+// element's `caribou:",key"` field or the map key. Riak maps aren't ordered, so slices of structs
+// are loaded back sorted by key; tag them with `caribou:",list"` as well to keep their order.
+// Nested structs are handled recursively. Nil pointer fields are left out and other pointers are
+// dereferenced.
+func encodeFields(m map[string]interface{}, v reflect.Value) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	// Build the result separately so that renamed fields can't collide with the ones that are
+	// yet to be processed. Keys that don't belong to a field are kept as they are.
+	out := make(map[string]interface{}, len(m))
+	for k, value := range m {
+		out[k] = value
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		value, ok := m[f.Name]
+		if !ok {
+			continue
+		}
+		delete(out, f.Name)
+
+		tag, err := tagOf(f)
+		if err != nil {
+			return err
+		}
+		if tag.omitempty && v.Field(i).IsZero() {
+			continue
+		}
+
+		// Nil pointers leave the field out, so that it is removed from Riak. Other pointers are
+		// stored as the value they point to, unless only the pointer type has a codec.
+		if f.Type.Kind() == reflect.Ptr {
+			if v.Field(i).IsNil() {
+				continue
+			}
+			if !isStruct(f.Type) && !(hasCodec(f.Type) && !hasCodec(f.Type.Elem())) {
+				value = v.Field(i).Elem().Interface()
+			}
+		}
+
+		switch {
+		case tag.list || isStructCollection(f.Type):
+			value, err = encodeCollection(v.Field(i), tag.list)
+			if err != nil {
+				return fmt.Errorf("Field %q: %v", f.Name, err)
+			}
+		case isStruct(f.Type):
+			if nested, ok := value.(map[string]interface{}); ok {
+				if err := encodeFields(nested, v.Field(i)); err != nil {
+					return err
+				}
+			} else if value, err = structToMap(v.Field(i)); err != nil {
+				return err
+			}
+		}
+
+		if tag.kind != crdtNone {
+			value = kindValue{tag.kind, value}
+		}
+		out[tag.name] = value
+	}
+
+	for k := range m {
+		delete(m, k)
+	}
+	for k, value := range out {
+		m[k] = value
+	}
+	return nil
+}
+
+// wrapKinds returns a copy of m, a map in the layout stored in Riak for the struct type t, in
+// which the values of fields with an explicit kind are wrapped the same way encodeFields wraps
+// them. This lets fillMapOp compare snapshots with the current state of a model.
+func wrapKinds(m map[string]interface{}, t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if m == nil || t.Kind() != reflect.Struct {
+		return m
+	}
+
+	out := make(map[string]interface{}, len(m))
+	for k, value := range m {
+		out[k] = value
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, err := tagOf(f)
+		if err != nil {
+			continue
+		}
+		value, ok := out[tag.name]
+		if !ok {
+			continue
+		}
+
+		if nested, ok := value.(map[string]interface{}); ok {
+			switch {
+			case isStructCollection(f.Type):
+				elements := make(map[string]interface{}, len(nested))
+				for k, elem := range nested {
+					if em, ok := elem.(map[string]interface{}); ok {
+						elements[k] = wrapKinds(em, f.Type.Elem())
+					} else {
+						elements[k] = elem
+					}
+				}
+				value = elements
+			case isStruct(f.Type):
+				value = wrapKinds(nested, f.Type)
+			}
+		}
+
+		if tag.kind != crdtNone {
+			value = kindValue{tag.kind, value}
+		}
+		out[tag.name] = value
+	}
+	return out
+}
+
+// isStruct reports whether t is a struct or a pointer to one that is stored as a nested map.
+// Structs with a codec, like time.Time, are stored in registers instead.
+func isStruct(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		if hasCodec(t) {
+			return false
+		}
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !hasCodec(t)
+}
+
+// isStructCollection reports whether t is a slice, array or map of structs.
+func isStructCollection(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return isStruct(t.Elem())
+	}
+	return false
+}
+
+// clearMissingPointers sets the pointer fields of the struct v that m, the map it was loaded from,
+// doesn't have to nil, so that fields removed from Riak don't keep the value of an earlier load.
+// Nested structs are handled recursively.
+func clearMissingPointers(m map[string]interface{}, v reflect.Value) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, err := tagOf(f)
+		if err != nil || f.PkgPath != "" {
+			continue
+		}
+		value, ok := m[tag.name]
+		switch {
+		case !ok && f.Type.Kind() == reflect.Ptr:
+			v.Field(i).Set(reflect.Zero(f.Type))
+		case isStruct(f.Type):
+			if nested, ok := value.(map[string]interface{}); ok {
+				clearMissingPointers(nested, v.Field(i))
+			}
+		}
+	}
+}
+
+// encodeCollection turns a slice, array or map into a map of element key => element. Lists are
+// keyed by index, other slices of structs by the `caribou:",key"` field of the elements and maps
+// by their keys. Struct elements are converted to maps.
+func encodeCollection(v reflect.Value, list bool) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, v.Len())
+
+	encodeElement := func(key string, elem reflect.Value) error {
+		if !isStruct(elem.Type()) {
+			m[key] = elem.Interface()
+			return nil
+		}
+		em, err := structToMap(elem)
+		if err != nil {
+			return err
+		}
+		m[key] = em
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			key := strconv.Itoa(i)
+			if !list {
+				var err error
+				key, err = elementKey(v.Index(i))
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := m[key]; ok {
+					return nil, fmt.Errorf("Duplicate element key %q", key)
+				}
+			}
+			if err := encodeElement(key, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			if err := encodeElement(fmt.Sprint(k.Interface()), v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// elementKey returns the value of the field tagged with `caribou:",key"` of the struct elem.
+func elementKey(elem reflect.Value) (string, error) {
+	for elem.Kind() == reflect.Ptr {
+		if elem.IsNil() {
+			return "", errors.New("Nil element")
+		}
+		elem = elem.Elem()
+	}
+
+	t := elem.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if tag, err := tagOf(t.Field(i)); err == nil && tag.key {
+			return fmt.Sprint(elem.Field(i).Interface()), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no field tagged `caribou:\",key\"`", t)
+}
+
+// structToMap converts a struct into a map in the layout stored in Riak, the same way the fields
+// of a model are laid out. Unexported fields are skipped.
+func structToMap(v reflect.Value) (map[string]interface{}, error) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	m := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if isStruct(f.Type) {
+			nested, err := structToMap(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			if nested != nil {
+				m[f.Name] = nested
+			}
+			continue
+		}
+		m[f.Name] = v.Field(i).Interface()
+	}
+
+	return m, encodeFields(m, v)
+}
+
+// mapToList turns a map of index => element back into a list. Keys that aren't indexes are
+// ignored, and gaps left by concurrent updates are closed up.
+func mapToList(m map[string]interface{}) []interface{} {
+	indexes := make([]int, 0, len(m))
+	elements := make(map[int]interface{}, len(m))
+	for k, v := range m {
+		if i, err := strconv.Atoi(k); err == nil && i >= 0 {
+			indexes = append(indexes, i)
+			elements[i] = v
+		}
+	}
+	sort.Ints(indexes)
+
+	list := make([]interface{}, len(indexes))
+	for n, i := range indexes {
+		list[n] = elements[i]
+	}
+	return list
+}
+
+// sortedValues returns the values of m ordered by key. Keys that are both numbers are compared
+// as numbers.
+func sortedValues(m map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, aerr := strconv.Atoi(keys[i])
+		b, berr := strconv.Atoi(keys[j])
+		if aerr == nil && berr == nil {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		values[i] = m[k]
+	}
+	return values
+}
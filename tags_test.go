@@ -0,0 +1,193 @@
+package caribou
+
+import (
+	"reflect"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+type Playlist struct {
+	ModelMetadata
+	testContext
+	Tracks []string `caribou:",list"`
+	Plays  []int64  `caribou:",list"`
+}
+
+func TestListRoundTrip(t *testing.T) {
+	original := &Playlist{Tracks: []string{"b", "a", "b"}, Plays: []int64{3, 1, 3}}
+	m := map[string]interface{}{"Tracks": original.Tracks, "Plays": original.Plays}
+	if err := encodeFields(m, reflect.ValueOf(original)); err != nil {
+		t.Fatal(err)
+	}
+	if tracks, ok := m["Tracks"].(map[string]interface{}); !ok || tracks["2"] != "b" {
+		t.Fatalf("Unexpected encoded list %#v", m["Tracks"])
+	}
+
+	var p Playlist
+	if err := LoadMapIntoModel(m, &p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Tracks, []string{"b", "a", "b"}) {
+		t.Errorf("Unexpected tracks %v", p.Tracks)
+	}
+	if !reflect.DeepEqual(p.Plays, []int64{3, 1, 3}) {
+		t.Errorf("Unexpected plays %v", p.Plays)
+	}
+}
+
+type Creative struct {
+	ID    string `caribou:",key"`
+	Width int64
+}
+
+type Placement struct {
+	ModelMetadata
+	testContext
+	Creatives []Creative
+	Sizes     map[string]Creative
+}
+
+func TestStructCollectionRoundTrip(t *testing.T) {
+	original := &Placement{
+		Creatives: []Creative{{"b", 300}, {"a", 728}},
+		Sizes:     map[string]Creative{"leaderboard": {"a", 728}},
+	}
+	m := map[string]interface{}{"Creatives": original.Creatives, "Sizes": original.Sizes}
+	if err := encodeFields(m, reflect.ValueOf(original)); err != nil {
+		t.Fatal(err)
+	}
+	creatives := m["Creatives"].(map[string]interface{})
+	if creatives["b"].(map[string]interface{})["Width"] != int64(300) {
+		t.Fatalf("Unexpected encoded creatives %#v", creatives)
+	}
+
+	var p Placement
+	if err := LoadMapIntoModel(m, &p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Creatives, []Creative{{"a", 728}, {"b", 300}}) {
+		t.Errorf("Unexpected creatives %v", p.Creatives)
+	}
+	if !reflect.DeepEqual(p.Sizes, original.Sizes) {
+		t.Errorf("Unexpected sizes %v", p.Sizes)
+	}
+
+	original.Creatives = append(original.Creatives, Creative{"a", 1})
+	m = map[string]interface{}{"Creatives": original.Creatives}
+	if err := encodeFields(m, reflect.ValueOf(original)); err == nil {
+		t.Error("Expected an error for duplicate element keys")
+	}
+}
+
+type Advertiser struct {
+	ModelMetadata
+	testContext
+	Name     string `caribou:"name"`
+	Active   bool   `caribou:"active,register"`
+	Clicks   int64  `caribou:"clicks,counter"`
+	Nickname string `caribou:"nick,omitempty"`
+}
+
+func TestStructTags(t *testing.T) {
+	a := &Advertiser{Name: "acme", Active: true, Clicks: 3}
+	m := map[string]interface{}{
+		"Name": a.Name, "Active": a.Active, "Clicks": a.Clicks, "Nickname": a.Nickname,
+	}
+	if err := encodeFields(m, reflect.ValueOf(a)); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"name":   "acme",
+		"active": kindValue{crdtRegister, true},
+		"clicks": kindValue{crdtCounter, int64(3)},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, m)
+	}
+
+	active, err := encodeRegister(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRegister(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded Advertiser
+	err = LoadMapIntoModel(map[string]interface{}{
+		"name": "acme", "active": decoded, "clicks": Counter(3), "nick": "ac",
+	}, &loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Name != "acme" || !loaded.Active || loaded.Clicks != 3 || loaded.Nickname != "ac" {
+		t.Errorf("Unexpected model %+v", loaded)
+	}
+
+	wrapped := wrapKinds(map[string]interface{}{"clicks": Counter(3)}, reflect.TypeOf(a))
+	if crdtTypeOf(wrapped["clicks"]) != crdtCounter {
+		t.Errorf("Unexpected snapshot %#v", wrapped)
+	}
+}
+
+type Listing struct {
+	ModelMetadata
+	testContext
+	Title    *string
+	Price    *int64
+	Location *Creative
+}
+
+func TestPointerFields(t *testing.T) {
+	price := int64(100)
+	l := &Listing{Price: &price, Location: &Creative{"home", 3}}
+	m := map[string]interface{}{"Title": l.Title, "Price": l.Price, "Location": l.Location}
+	if err := encodeFields(m, reflect.ValueOf(l)); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"Price":    int64(100),
+		"Location": map[string]interface{}{"ID": "home", "Width": int64(3)},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, m)
+	}
+
+	// The nil title removes the register that was stored before.
+	store := NewMemoryStore()
+	from := map[string]interface{}{"Title": "old", "Price": int64(90)}
+	noKindChange := func() *riak.MapOperation {
+		t.Fatal("Unexpected kind change")
+		return nil
+	}
+	var create, op riak.MapOperation
+	if err := fillMapOp(map[string]interface{}{}, from, &create, noKindChange); err != nil {
+		t.Fatal(err)
+	}
+	if err := fillMapOp(from, m, &op, noKindChange); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []*riak.MapOperation{&create, &op} {
+		if _, err := store.Apply("l", op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm, _, _ := store.Fetch("l")
+	stored, err := decodeRegister(string(rm.Registers["Price"]))
+	if _, ok := rm.Registers["Title"]; ok || err != nil || stored != int64(100) {
+		t.Errorf("Expected Title to be removed and Price to be 100, got %+v", rm)
+	}
+
+	// Loading leaves missing pointers nil, even if they were set before.
+	title := "stale"
+	loaded := Listing{Title: &title}
+	if err := LoadMapIntoModel(m, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Title != nil || loaded.Price == nil || *loaded.Price != 100 ||
+	loaded.Location == nil || loaded.Location.ID != "home" {
+		t.Errorf("Unexpected model %+v", loaded)
+	}
+}
@@ -0,0 +1,149 @@
+package caribou
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MigrationRecorder is told about every map that goes through FastForwardMap, which is what
+// LoadMapIntoModel uses. Knowing which versions are still being read tells when a migration can
+// safely be retired. Models reloaded after they were saved aren't recorded again.
+type MigrationRecorder interface {
+	// RecordMigration is called with the type name of the Caribou, the version the map was at,
+	// the number of migrations that were applied and the time it took to apply them. It is
+	// called for maps that didn't need any migrations too.
+	RecordMigration(modelType, fromVersion string, applied int, d time.Duration)
+}
+
+// DefaultRecorder receives a record of every FastForwardMap call. It is nil by default, which
+// turns recording off.
+var DefaultRecorder MigrationRecorder
+
+// caribouType returns the name of the type of c without the pointer, e.g. "caribou.Account".
+func caribouType(c Caribou) string {
+	t := reflect.TypeOf(c)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
+// VersionHistogram is an in-memory MigrationRecorder that counts the versions maps are read at,
+// per model type. It implements expvar.Var, so it can be published with expvar.Publish, and can
+// write itself in the Prometheus text format.
+type VersionHistogram struct {
+	mu     sync.Mutex
+	models map[string]*modelStats
+}
+
+// modelStats holds the VersionHistogram data of a single model type.
+type modelStats struct {
+	Versions map[string]int64
+	Applied  int64
+	Seconds  float64
+}
+
+// NewVersionHistogram returns an empty VersionHistogram.
+func NewVersionHistogram() *VersionHistogram {
+	return &VersionHistogram{models: make(map[string]*modelStats)}
+}
+
+// RecordMigration implements MigrationRecorder.
+func (h *VersionHistogram) RecordMigration(modelType, fromVersion string, applied int,
+d time.Duration) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := h.models[modelType]
+	if stats == nil {
+		stats = &modelStats{Versions: make(map[string]int64)}
+		h.models[modelType] = stats
+	}
+	stats.Versions[fromVersion]++
+	stats.Applied += int64(applied)
+	stats.Seconds += d.Seconds()
+}
+
+// Versions returns the number of maps read at each version for the given model type.
+func (h *VersionHistogram) Versions(modelType string) map[string]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions := make(map[string]int64)
+	if stats := h.models[modelType]; stats != nil {
+		for v, n := range stats.Versions {
+			versions[v] = n
+		}
+	}
+	return versions
+}
+
+// String returns the histogram as JSON, keyed by model type. It implements expvar.Var.
+func (h *VersionHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, err := json.Marshal(h.models)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// WritePrometheus writes the histogram to w in the Prometheus text exposition format.
+func (h *VersionHistogram) WritePrometheus(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	types := make([]string, 0, len(h.models))
+	for t := range h.models {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	var b strings.Builder
+	b.WriteString("# HELP caribou_loads_total Maps loaded, by model and stored version.\n")
+	b.WriteString("# TYPE caribou_loads_total counter\n")
+	for _, t := range types {
+		versions := make([]string, 0, len(h.models[t].Versions))
+		for v := range h.models[t].Versions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		for _, v := range versions {
+			fmt.Fprintf(&b, "caribou_loads_total{model=\"%s\",version=\"%s\"} %d\n",
+				escapeLabel(t), escapeLabel(v), h.models[t].Versions[v])
+		}
+	}
+
+	b.WriteString("# HELP caribou_migrations_applied_total Migrations applied, by model.\n")
+	b.WriteString("# TYPE caribou_migrations_applied_total counter\n")
+	for _, t := range types {
+		fmt.Fprintf(&b, "caribou_migrations_applied_total{model=\"%s\"} %d\n", escapeLabel(t),
+			h.models[t].Applied)
+	}
+
+	b.WriteString("# HELP caribou_migration_seconds_total Time spent migrating, by model.\n")
+	b.WriteString("# TYPE caribou_migration_seconds_total counter\n")
+	for _, t := range types {
+		fmt.Fprintf(&b, "caribou_migration_seconds_total{model=\"%s\"} %g\n", escapeLabel(t),
+			h.models[t].Seconds)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,63 @@
+package caribou
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionHistogram(t *testing.T) {
+	h := NewVersionHistogram()
+	DefaultRecorder = h
+	defer func() { DefaultRecorder = nil }()
+
+	g := &gadget{migrations: []*Migration{renameMigration("a_to_b", "A", "B")}}
+	if _, err := FastForwardMap(g, map[string]interface{}{"A": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FastForwardMap(g, map[string]interface{}{"B": "y"}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := h.Versions("caribou.gadget")
+	if len(versions) != 2 || versions[""] != 1 || versions["a_to_b"] != 1 {
+		t.Errorf("Unexpected versions %v", versions)
+	}
+
+	var b strings.Builder
+	if err := h.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`caribou_loads_total{model="caribou.gadget",version="a_to_b"} 1`,
+		`caribou_migrations_applied_total{model="caribou.gadget"} 1`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("Missing %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestVersionHistogramSkipsSaves(t *testing.T) {
+	h := NewVersionHistogram()
+	DefaultRecorder = h
+	defer func() { DefaultRecorder = nil }()
+
+	store := NewMemoryStore()
+	if err := store.Save(&Gizmo{Color: "red"}, "g"); err != nil {
+		t.Fatal(err)
+	}
+	var g Gizmo
+	if _, err := store.Find(&g, "g"); err != nil {
+		t.Fatal(err)
+	}
+	g.Color = "blue"
+	if err := store.Save(&g, "g"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the Find is a load.
+	versions := h.Versions("caribou.Gizmo")
+	if len(versions) != 1 || versions[""] != 1 {
+		t.Errorf("Unexpected versions %v", versions)
+	}
+}
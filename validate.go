@@ -0,0 +1,112 @@
+package caribou
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// InvalidMigrationsError is returned by ValidateMigrations and lists everything that is wrong with
+// a Caribou's migration chain.
+type InvalidMigrationsError struct {
+	// Caribou is the type name of the Caribou.
+	Caribou string
+
+	// Problems describes each problem found, in the order of the migration chain.
+	Problems []string
+}
+
+func (e *InvalidMigrationsError) Error() string {
+	return fmt.Sprintf("Invalid migrations for %s: %s", e.Caribou, strings.Join(e.Problems, "; "))
+}
+
+// ValidateMigrations checks that the migration chain of c can be used by FastForwardMap: every
+// migration has a unique, non-empty name and exactly one of Migrate and TryMigrate, and
+// Migrations returns the same chain every time it is called. Migrations retired by a MinVersioner
+// only need a name. It is meant to be called from init() or a test so that a broken chain is
+// found before it reaches production data.
+func ValidateMigrations(c Caribou) error {
+	var problems []string
+	migrations := c.Migrations()
+
+	// Migrations up to the minimum version are retired markers that don't need functions.
+	retired := -1
+	if min := minVersion(c); min != "" {
+		retired = migrationIndex(migrations, min)
+		if retired < 0 {
+			problems = append(problems, fmt.Sprintf("minimum version %q is not a migration", min))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, m := range migrations {
+		if m == nil {
+			problems = append(problems, fmt.Sprintf("migration %d is nil", i))
+			continue
+		}
+		if m.Name == "" {
+			problems = append(problems, fmt.Sprintf("migration %d has no name", i))
+		} else if seen[m.Name] {
+			problems = append(problems, fmt.Sprintf("migration %q is defined more than once",
+				m.Name))
+		}
+		seen[m.Name] = true
+
+		switch {
+		case i <= retired:
+		case m.Migrate == nil && m.TryMigrate == nil:
+			problems = append(problems, fmt.Sprintf("migration %q has no migrate function",
+				m.Name))
+		case m.Migrate != nil && m.TryMigrate != nil:
+			problems = append(problems, fmt.Sprintf("migration %q sets both Migrate and TryMigrate",
+				m.Name))
+		}
+	}
+
+	// The chain has to come out the same on every call, or versions would mean different things
+	// on different reads.
+	again := c.Migrations()
+	stable := len(again) == len(migrations)
+	for i := 0; stable && i < len(again); i++ {
+		stable = again[i] != nil && migrations[i] != nil && again[i].Name == migrations[i].Name
+	}
+	if !stable {
+		problems = append(problems, "Migrations doesn't return the same chain on every call")
+	}
+
+	if len(problems) > 0 {
+		return &InvalidMigrationsError{reflect.TypeOf(c).String(), problems}
+	}
+	return nil
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []Caribou
+)
+
+// Register adds c to the set of Caribous checked by ValidateRegisteredMigrations. Models usually
+// register a zero value of themselves from init().
+func Register(c Caribou) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// ValidateRegisteredMigrations runs ValidateMigrations on every registered Caribou and returns
+// all of the errors joined together.
+func ValidateRegisteredMigrations() error {
+	registryMu.Lock()
+	cs := append([]Caribou(nil), registry...)
+	registryMu.Unlock()
+
+	var errs []error
+	for _, c := range cs {
+		if err := ValidateMigrations(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
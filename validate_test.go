@@ -0,0 +1,29 @@
+package caribou
+
+import (
+	"testing"
+)
+
+func TestValidateMigrations(t *testing.T) {
+	g := &gadget{migrations: []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		renameMigration("b_to_c", "B", "C"),
+	}}
+	if err := ValidateMigrations(g); err != nil {
+		t.Error(err)
+	}
+
+	g.migrations = []*Migration{
+		renameMigration("a_to_b", "A", "B"),
+		renameMigration("", "B", "C"),
+		renameMigration("a_to_b", "C", "D"),
+		&Migration{Name: "noop"},
+	}
+	err, ok := ValidateMigrations(g).(*InvalidMigrationsError)
+	if !ok {
+		t.Fatalf("Expected InvalidMigrationsError, got %v", err)
+	}
+	if len(err.Problems) != 3 {
+		t.Errorf("Expected 3 problems, got %v", err.Problems)
+	}
+}
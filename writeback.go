@@ -0,0 +1,83 @@
+package caribou
+
+import (
+	"sync"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+// DefaultWriteBack is used by FindRiakModelByKey to write lazily migrated maps back to Riak. It
+// is nil by default, which leaves stored maps at their old version until they are saved.
+var DefaultWriteBack *WriteBack
+
+// A WriteBack writes migrated maps back to Riak in the background so that old versions don't
+// linger in storage and later reads don't pay the migration cost again. Write-backs never block
+// the read that triggered them: when all writes are busy, new write-backs are dropped and
+// reported to OnDrop, and the map stays at its old version until it is read again.
+type WriteBack struct {
+	// OnError is called with the bucket, key and error of every write-back that fails. It may be
+	// called from several goroutines at once.
+	OnError func(bucketName, key string, err error)
+
+	// OnDrop is called with the bucket and key of every write-back that is dropped because all
+	// writes are busy.
+	OnDrop func(bucketName, key string)
+
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewWriteBack returns a WriteBack that runs at most concurrency writes at a time.
+func NewWriteBack(concurrency int) *WriteBack {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &WriteBack{slots: make(chan struct{}, concurrency)}
+}
+
+// Wait blocks until all scheduled write-backs have finished.
+func (w *WriteBack) Wait() {
+	w.wg.Wait()
+}
+
+// schedule writes the migrations applied to model since original was stored back with update,
+// which applies the map operations with the given context. The map operations are built right
+// away, against the context the model was read with, so the caller is free to modify the model
+// afterwards. If all slots are busy the write-back is dropped and reported to OnDrop; the next
+// read of the key will schedule it again.
+func (w *WriteBack) schedule(model Model, original map[string]interface{}, bucketName, key string,
+update func(ops []*riak.MapOperation, ctx string) error) {
+
+	ops, err := buildMapOperations(model, original)
+	if err != nil {
+		w.fail(bucketName, key, err)
+		return
+	}
+	ctx := model.GetContext()
+
+	select {
+	case w.slots <- struct{}{}:
+	default:
+		if w.OnDrop != nil {
+			w.OnDrop(bucketName, key)
+		}
+		return
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.slots }()
+
+		if err := update(ops, ctx); err != nil {
+			w.fail(bucketName, key, err)
+		}
+	}()
+}
+
+// fail reports a failed write-back to OnError, if it is set.
+func (w *WriteBack) fail(bucketName, key string, err error) {
+	if w.OnError != nil {
+		w.OnError(bucketName, key, err)
+	}
+}
@@ -0,0 +1,124 @@
+package caribou
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+// storeUpdate returns a write-back update function that applies the operations to key in store.
+func storeUpdate(store *MemoryStore, key string) func([]*riak.MapOperation, string) error {
+	return func(ops []*riak.MapOperation, ctx string) error {
+		for _, op := range ops {
+			if _, err := store.Apply(key, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// storeOldGizmo stores a gizmo from before its colour_to_color migration and loads it, returning
+// the loaded model and the map as it was stored.
+func storeOldGizmo(t *testing.T, store *MemoryStore, key string) (*Gizmo, map[string]interface{}) {
+	var op riak.MapOperation
+	op.SetRegister("Colour", []byte("blue"))
+	if _, err := store.Apply(key, &op); err != nil {
+		t.Fatal(err)
+	}
+
+	rm, ctx, _ := store.Fetch(key)
+	g := &Gizmo{}
+	original, err := loadRiakModel(&riak.FetchMapResponse{Context: ctx, Map: rm}, g, keepOriginal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original == nil {
+		t.Fatal("Expected the gizmo to be migrated")
+	}
+	return g, original
+}
+
+func TestWriteBack(t *testing.T) {
+	store := NewMemoryStore()
+	g, original := storeOldGizmo(t, store, "g")
+
+	wb := NewWriteBack(1)
+	wb.OnError = func(bucketName, key string, err error) { t.Error(err) }
+	wb.schedule(g, original, "gizmos", "g", storeUpdate(store, "g"))
+	wb.Wait()
+
+	rm, _, _ := store.Fetch("g")
+	if _, ok := rm.Registers["Colour"]; ok || string(rm.Registers["Color"]) == "" {
+		t.Errorf("Expected the migration to be written back, got %+v", rm)
+	}
+}
+
+func TestWriteBackDropsWhenBusy(t *testing.T) {
+	store := NewMemoryStore()
+	g, original := storeOldGizmo(t, store, "g")
+
+	wb := NewWriteBack(1)
+	var dropped []string
+	wb.OnDrop = func(bucketName, key string) {
+		dropped = append(dropped, bucketName+"/"+key)
+	}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	update := func([]*riak.MapOperation, string) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return nil
+	}
+
+	wb.schedule(g, original, "gizmos", "g", update)
+	wb.schedule(g, original, "gizmos", "g", update)
+	close(release)
+	wb.Wait()
+
+	if calls != 1 || len(dropped) != 1 || dropped[0] != "gizmos/g" {
+		t.Errorf("Expected the second write-back to be dropped, got %d calls and drops %q",
+			calls, dropped)
+	}
+}
+
+func TestWriteBackOnError(t *testing.T) {
+	store := NewMemoryStore()
+	g, original := storeOldGizmo(t, store, "g")
+
+	var mu sync.Mutex
+	var failed []error
+	wb := NewWriteBack(2)
+	wb.OnError = func(bucketName, key string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if bucketName != "gizmos" || key != "g" {
+			t.Errorf("Unexpected key %s/%s", bucketName, key)
+		}
+		failed = append(failed, err)
+	}
+
+	// The update fails.
+	errUpdate := errors.New("Update failed")
+	wb.schedule(g, original, "gizmos", "g", func([]*riak.MapOperation, string) error {
+		return errUpdate
+	})
+	wb.Wait()
+
+	// Building the operations fails, because the model is at an unknown version.
+	g.SetVersion("from_the_future")
+	wb.schedule(g, original, "gizmos", "g", func([]*riak.MapOperation, string) error {
+		t.Error("Unexpected update")
+		return nil
+	})
+	wb.Wait()
+
+	if len(failed) != 2 || failed[0] != errUpdate || !errors.Is(failed[1], ErrUnknownVersion) {
+		t.Errorf("Unexpected errors %v", failed)
+	}
+}